@@ -0,0 +1,208 @@
+// Request authorization
+
+package connectionmanager
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Decides whether a request may go ahead
+//
+// The manager consults its Authorizer before handling any request
+// that acts for a connection or reads the manager's state, and for the
+// message inside a ScheduleRequest. Requests whose Id names something other than a
+// connection (CancelRequest, DeadLettersRequest, RequeueRequest,
+// PurgeRequest, and LookupRequest by public ID) are passed as a copy
+// with the ID of the connection they act for in Id: the scheduled
+// message's sender, or the dead letters' recipient. Authorize is called
+// from the manager's goroutine, so it must be quick and must not call
+// SendMessage.
+type Authorizer[T any] interface {
+	// Return nil to allow the request, or an error giving the reason
+	// it's denied. credentials are the request's Credentials.
+	Authorize(m *TypedMessage[T], credentials interface{}) error
+}
+
+// Returned in the Err field of the response to a denied request
+type AuthorizationError struct {
+	// the denied request's type and ID
+	Type MessageType
+	Id   string
+
+	// the Authorizer's reason
+	Err error
+}
+
+func (e *AuthorizationError) Error() string {
+	return fmt.Sprintf("%s not authorized (message type %d): %v", e.Id, e.Type, e.Err)
+}
+
+func (e *AuthorizationError) Unwrap() error {
+	return e.Err
+}
+
+// Set the Authorizer consulted before handling requests (nil, the
+// default, allows everything)
+//
+// Must be called before SetActive(true).
+func (cm *Manager[T]) SetAuthorizer(a Authorizer[T]) {
+	cm.authorizer = a
+}
+
+// Ask the Authorizer about a request
+//
+// Returns an *AuthorizationError if it's denied.
+func (cm *Manager[T]) authorize(m *TypedMessage[T]) error {
+	if cm.authorizer == nil {
+		return nil
+	}
+
+	checked := m
+
+	switch m.Type {
+	case ConnectRequest, DisconnectRequest, PollRequest, AbandonRequest, BroadcastRequest, UnicastRequest,
+		SubscribeRequest, UnsubscribeRequest, PublishRequest, QueryRequest, ReplyRequest,
+		ScheduledRequest, StatsRequest:
+
+	case CancelRequest, DeadLettersRequest, RequeueRequest, PurgeRequest, LookupRequest:
+		// what the request names is left for the handler to refuse
+		// if it doesn't exist
+		id, ok := cm.actingId(m)
+		if !ok {
+			return nil
+		}
+
+		subject := *m
+		subject.Id = id
+		checked = &subject
+
+	case ScheduleRequest:
+		// it's the scheduled message that needs to be allowed; a
+		// malformed request is left for the handler to refuse
+		sm, ok := m.General.(*TypedMessage[T])
+		if !ok {
+			return nil
+		}
+		checked = sm
+
+	default:
+		return nil
+	}
+
+	if err := cm.authorizer.Authorize(checked, m.Credentials); err != nil {
+		return &AuthorizationError{Type: checked.Type, Id: checked.Id, Err: err}
+	}
+
+	return nil
+}
+
+// Return the ID of the connection a request acts for, when its Id
+// names something else, or false if that thing doesn't exist
+func (cm *Manager[T]) actingId(m *TypedMessage[T]) (string, bool) {
+	switch m.Type {
+	case CancelRequest:
+		if s, ok := cm.scheduled[m.Id]; ok {
+			return s.message.Id, true
+		}
+
+	case DeadLettersRequest:
+		return m.DestId, true
+
+	case RequeueRequest, PurgeRequest:
+		if m.Type == PurgeRequest && m.Id == "" {
+			return m.DestId, true
+		}
+
+		if e, ok := cm.deadLetters.byId[m.Id]; ok {
+			return e.Value.(*TypedDeadLetter[T]).DestId, true
+		}
+
+	case LookupRequest:
+		if m.PublicId == "" {
+			return m.Id, true
+		}
+
+		if id, ok := cm.publicIds[m.PublicId]; ok {
+			return id, true
+		}
+	}
+
+	return "", false
+}
+
+// A simple Authorizer: each caller proves who it is with a secret
+// token as its Credentials, and can only act as itself
+//
+// Requests are allowed when their Id is the one the token was granted
+// for. Once any ID has been allowed to broadcast, only those IDs can.
+// Methods are safe for concurrent use.
+type TokenPolicy[T any] struct {
+	lock sync.Mutex
+
+	// connection ID for each token
+	tokens map[string]string
+
+	// IDs allowed to broadcast, if broadcasting is restricted
+	broadcasters map[string]bool
+}
+
+// Create a TokenPolicy with no tokens
+func NewTokenPolicy[T any]() *TokenPolicy[T] {
+	return &TokenPolicy[T]{
+		tokens: make(map[string]string),
+	}
+}
+
+// Let the holder of token act as id
+func (p *TokenPolicy[T]) Grant(token string, id string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.tokens[token] = id
+}
+
+// Stop accepting a token
+func (p *TokenPolicy[T]) Revoke(token string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.tokens, token)
+}
+
+// Let id broadcast, and stop IDs that haven't been allowed from
+// broadcasting
+func (p *TokenPolicy[T]) AllowBroadcast(id string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.broadcasters == nil {
+		p.broadcasters = make(map[string]bool)
+	}
+
+	p.broadcasters[id] = true
+}
+
+// Check a request against the policy
+func (p *TokenPolicy[T]) Authorize(m *TypedMessage[T], credentials interface{}) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	token, _ := credentials.(string)
+
+	id, ok := p.tokens[token]
+	if !ok || token == "" {
+		return errors.New("unknown token")
+	}
+
+	if m.Id != id {
+		return errors.New(fmt.Sprintf("token is for %s", id))
+	}
+
+	if m.Type == BroadcastRequest && p.broadcasters != nil && !p.broadcasters[id] {
+		return errors.New("not allowed to broadcast")
+	}
+
+	return nil
+}
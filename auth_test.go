@@ -0,0 +1,137 @@
+package connectionmanager
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenPolicy(t *testing.T) {
+	policy := NewTokenPolicy[*MessagePayload]()
+	policy.Grant("alpha-secret", "alpha")
+	policy.Grant("beta-secret", "beta")
+
+	cm := New()
+	cm.SetAuthorizer(policy)
+	cm.SetActive(true)
+	defer cm.SetActive(false)
+
+	send := func(m *Message) error {
+		return cm.SendMessage(m).Err
+	}
+
+	for _, id := range []string{"alpha", "beta"} {
+		if err := send(&Message{Type: ConnectRequest, Id: id, Credentials: id + "-secret"}); err != nil {
+			t.Fatalf("ConnectRequest %s: %v", id, err)
+		}
+	}
+
+	// someone else's ID, and no credentials at all, are denied
+	var ae *AuthorizationError
+	if err := send(&Message{Type: PollRequest, Id: "alpha", Credentials: "beta-secret"}); !errors.As(err, &ae) || ae.Id != "alpha" {
+		t.Errorf("expected AuthorizationError for alpha, got %v", err)
+	}
+
+	if err := send(&Message{Type: BroadcastRequest, Id: "alpha"}); !errors.As(err, &ae) {
+		t.Errorf("expected AuthorizationError, got %v", err)
+	}
+
+	if err := send(&Message{Type: SubscribeRequest, Id: "beta", Group: "g", Credentials: "beta-secret"}); err != nil {
+		t.Errorf("SubscribeRequest: %v", err)
+	}
+
+	// scheduled messages are checked when they're scheduled
+	err := send(&Message{
+		Type:        ScheduleRequest,
+		At:          time.Now(),
+		Credentials: "beta-secret",
+		General:     &Message{Type: UnicastRequest, Id: "alpha", DestId: "beta"},
+	})
+	if !errors.As(err, &ae) || ae.Type != UnicastRequest {
+		t.Errorf("expected AuthorizationError for the unicast, got %v", err)
+	}
+
+	// as are requests that act on a connection, or on what it owns
+	if err := send(&Message{Type: DisconnectRequest, Id: "alpha", Credentials: "beta-secret"}); !errors.As(err, &ae) || ae.Id != "alpha" {
+		t.Errorf("expected AuthorizationError for the disconnect, got %v", err)
+	}
+
+	if err := send(&Message{Type: PollRequest, Id: "alpha", Credentials: "alpha-secret", Timeout: time.Millisecond}); err != nil {
+		t.Errorf("alpha was disconnected anyway: %v", err)
+	}
+
+	resp := cm.SendMessage(&Message{
+		Type:        ScheduleRequest,
+		At:          time.Now().Add(time.Hour),
+		Credentials: "beta-secret",
+		General:     &Message{Type: UnicastRequest, Id: "beta", DestId: "alpha", Credentials: "beta-secret"},
+	})
+	if resp.Err != nil {
+		t.Fatalf("ScheduleRequest: %v", resp.Err)
+	}
+
+	// the schedule can only be listed a connection at a time, and
+	// without the credentials the messages were sent with
+	if err := send(&Message{Type: ScheduledRequest, Credentials: "alpha-secret"}); !errors.As(err, &ae) {
+		t.Errorf("expected AuthorizationError for the whole schedule, got %v", err)
+	}
+
+	if err := send(&Message{Type: ScheduledRequest, Id: "beta", Credentials: "alpha-secret"}); !errors.As(err, &ae) || ae.Id != "beta" {
+		t.Errorf("expected AuthorizationError for beta's schedule, got %v", err)
+	}
+
+	list := cm.SendMessage(&Message{Type: ScheduledRequest, Id: "alpha", Credentials: "alpha-secret"}).General.([]ScheduledMessage)
+	if len(list) != 0 {
+		t.Errorf("expected nothing scheduled by alpha, got %v", list)
+	}
+
+	list = cm.SendMessage(&Message{Type: ScheduledRequest, Id: "beta", Credentials: "beta-secret"}).General.([]ScheduledMessage)
+	if len(list) != 1 || list[0].Id != resp.Id || list[0].Message.Credentials != nil {
+		t.Errorf("expected beta's message without credentials, got %+v", list)
+	}
+
+	if err := send(&Message{Type: StatsRequest}); !errors.As(err, &ae) {
+		t.Errorf("expected AuthorizationError for stats, got %v", err)
+	}
+
+	if err := send(&Message{Type: CancelRequest, Id: resp.Id, Credentials: "alpha-secret"}); !errors.As(err, &ae) || ae.Id != "beta" {
+		t.Errorf("expected AuthorizationError for beta's schedule, got %v", err)
+	}
+
+	if err := send(&Message{Type: CancelRequest, Id: resp.Id, Credentials: "beta-secret"}); err != nil {
+		t.Errorf("CancelRequest: %v", err)
+	}
+
+	if err := send(&Message{Type: DeadLettersRequest, DestId: "beta", Credentials: "alpha-secret"}); !errors.As(err, &ae) {
+		t.Errorf("expected AuthorizationError for beta's dead letters, got %v", err)
+	}
+
+	// broadcasting can be restricted
+	policy.AllowBroadcast("beta")
+
+	if err := send(&Message{Type: BroadcastRequest, Id: "alpha", Credentials: "alpha-secret"}); !errors.As(err, &ae) {
+		t.Errorf("expected alpha to be denied broadcast, got %v", err)
+	}
+
+	if err := send(&Message{Type: BroadcastRequest, Id: "beta", Credentials: "beta-secret"}); err != nil {
+		t.Errorf("beta broadcast: %v", err)
+	}
+
+	// and tokens revoked
+	policy.Revoke("beta-secret")
+
+	if err := send(&Message{Type: BroadcastRequest, Id: "beta", Credentials: "beta-secret"}); !errors.As(err, &ae) {
+		t.Errorf("expected revoked token to be denied, got %v", err)
+	}
+
+	// the HTTP handlers take a token parameter
+	server := httptest.NewServer(NewLongPollHandler(cm))
+	defer server.Close()
+
+	var status map[string]string
+	if code := longPollTest(t, server, "id=alpha&token=beta-secret", &status); code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d %v", code, status)
+	}
+}
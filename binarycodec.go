@@ -0,0 +1,472 @@
+// Compact binary payload codec
+
+package connectionmanager
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Value tags for binaryCodec
+const (
+	binNil   byte = 0
+	binFalse byte = 1
+	binTrue  byte = 2
+	binInt   byte = 3 // zigzag varint
+	binUint  byte = 4 // uvarint
+	binFloat byte = 5 // 8 byte little-endian IEEE 754
+	binStr   byte = 6 // uvarint length, bytes
+	binBytes byte = 7 // uvarint length, bytes
+	binList  byte = 8 // uvarint count, values
+	binMap   byte = 9 // uvarint count, key/value pairs
+)
+
+var errBinaryShort = errors.New("binary codec: truncated data")
+
+// Deepest nesting of lists and maps binaryCodec will encode or decode,
+// so that hostile data or a value that contains itself can't exhaust
+// the stack
+const binaryMaxDepth = 1000
+
+var errBinaryDeep = errors.New(fmt.Sprintf("binary codec: nested more than %d deep", binaryMaxDepth))
+
+// Compact self-describing binary codec (implements Codec)
+//
+// Every value is a tag byte followed by its data. Structs are encoded
+// as maps of exported field name to value, and types implementing
+// encoding.BinaryMarshaler (like time.Time) as bytes. Decoding into an
+// interface{} gives nil, bool, int64, uint64, float64, string, []byte,
+// []interface{} or map[string]interface{}.
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string { return "binary" }
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	return binaryAppend(nil, reflect.ValueOf(v), 0)
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("binary codec: Unmarshal needs a non-nil pointer")
+	}
+
+	rest, err := binaryDecode(data, rv.Elem(), 0)
+	if err != nil {
+		return err
+	}
+
+	if len(rest) != 0 {
+		return errors.New(fmt.Sprintf("binary codec: %d bytes of trailing data", len(rest)))
+	}
+
+	return nil
+}
+
+// Append a length- or count-prefixed header
+func binaryAppendHeader(buf []byte, tag byte, n int) []byte {
+	buf = append(buf, tag)
+	return binary.AppendUvarint(buf, uint64(n))
+}
+
+// Append the encoding of v, nested depth lists and maps deep, to buf
+func binaryAppend(buf []byte, v reflect.Value, depth int) ([]byte, error) {
+	if !v.IsValid() {
+		return append(buf, binNil), nil
+	}
+
+	if depth > binaryMaxDepth {
+		return nil, errBinaryDeep
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			return append(buf, binNil), nil
+		}
+	}
+
+	if v.CanInterface() {
+		if bm, ok := v.Interface().(encoding.BinaryMarshaler); ok {
+			data, err := bm.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+
+			buf = binaryAppendHeader(buf, binBytes, len(data))
+			return append(buf, data...), nil
+		}
+	}
+
+	var err error
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		// a pointer to a pointer counts as nesting, so a cycle of
+		// them can't go on forever
+		e := v.Elem()
+		if e.Kind() == reflect.Ptr || e.Kind() == reflect.Interface {
+			return binaryAppend(buf, e, depth+1)
+		}
+		return binaryAppend(buf, e, depth)
+
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, binTrue), nil
+		}
+		return append(buf, binFalse), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf = append(buf, binInt)
+		return binary.AppendVarint(buf, v.Int()), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf = append(buf, binUint)
+		return binary.AppendUvarint(buf, v.Uint()), nil
+
+	case reflect.Float32, reflect.Float64:
+		buf = append(buf, binFloat)
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v.Float())), nil
+
+	case reflect.String:
+		buf = binaryAppendHeader(buf, binStr, v.Len())
+		return append(buf, v.String()...), nil
+
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf = binaryAppendHeader(buf, binBytes, v.Len())
+			for i := 0; i < v.Len(); i++ {
+				buf = append(buf, byte(v.Index(i).Uint()))
+			}
+			return buf, nil
+		}
+
+		buf = binaryAppendHeader(buf, binList, v.Len())
+		for i := 0; i < v.Len() && err == nil; i++ {
+			buf, err = binaryAppend(buf, v.Index(i), depth+1)
+		}
+		return buf, err
+
+	case reflect.Map:
+		buf = binaryAppendHeader(buf, binMap, v.Len())
+		iter := v.MapRange()
+		for iter.Next() && err == nil {
+			if buf, err = binaryAppend(buf, iter.Key(), depth+1); err == nil {
+				buf, err = binaryAppend(buf, iter.Value(), depth+1)
+			}
+		}
+		return buf, err
+
+	case reflect.Struct:
+		t := v.Type()
+
+		var fields []int
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				fields = append(fields, i)
+			}
+		}
+
+		buf = binaryAppendHeader(buf, binMap, len(fields))
+		for _, i := range fields {
+			buf = binaryAppendHeader(buf, binStr, len(t.Field(i).Name))
+			buf = append(buf, t.Field(i).Name...)
+			if buf, err = binaryAppend(buf, v.Field(i), depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("binary codec: unsupported type %s", v.Type()))
+}
+
+// Read a uvarint from data
+func binaryUvarint(data []byte) (uint64, []byte, error) {
+	n, size := binary.Uvarint(data)
+	if size <= 0 {
+		return 0, nil, errBinaryShort
+	}
+
+	return n, data[size:], nil
+}
+
+// Read a length-prefixed byte string from data
+func binaryChunk(data []byte) ([]byte, []byte, error) {
+	n, data, err := binaryUvarint(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if uint64(len(data)) < n {
+		return nil, nil, errBinaryShort
+	}
+
+	return data[:n], data[n:], nil
+}
+
+// Decode a value without a destination type, nested depth deep
+func binaryDecodeDynamic(data []byte, depth int) (interface{}, []byte, error) {
+	var v interface{}
+
+	rest, err := binaryDecode(data, reflect.ValueOf(&v).Elem(), depth)
+
+	return v, rest, err
+}
+
+// Decode one value from data into v, which must be settable, nested
+// depth lists and maps deep
+//
+// Returns the data after the value.
+func binaryDecode(data []byte, v reflect.Value, depth int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errBinaryShort
+	}
+
+	if depth > binaryMaxDepth {
+		return nil, errBinaryDeep
+	}
+
+	tag := data[0]
+
+	if tag == binNil {
+		v.Set(reflect.Zero(v.Type()))
+		return data[1:], nil
+	}
+
+	// types that decode themselves
+	if tag == binBytes && v.CanAddr() {
+		if bu, ok := v.Addr().Interface().(encoding.BinaryUnmarshaler); ok {
+			chunk, rest, err := binaryChunk(data[1:])
+			if err != nil {
+				return nil, err
+			}
+
+			return rest, bu.UnmarshalBinary(chunk)
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return binaryDecode(data, v.Elem(), depth)
+
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			break
+		}
+		return binaryDecodeInterface(data, v, depth)
+	}
+
+	mismatch := func() error {
+		return errors.New(fmt.Sprintf("binary codec: can't decode tag %d into %s", tag, v.Type()))
+	}
+
+	data = data[1:]
+
+	switch tag {
+	case binFalse, binTrue:
+		if v.Kind() != reflect.Bool {
+			return nil, mismatch()
+		}
+		v.SetBool(tag == binTrue)
+		return data, nil
+
+	case binInt, binUint:
+		var i int64
+		var u uint64
+		var size int
+
+		if tag == binInt {
+			i, size = binary.Varint(data)
+			u = uint64(i)
+		} else {
+			u, size = binary.Uvarint(data)
+			i = int64(u)
+		}
+		if size <= 0 {
+			return nil, errBinaryShort
+		}
+
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if (tag == binUint && u > math.MaxInt64) || v.OverflowInt(i) {
+				return nil, mismatch()
+			}
+			v.SetInt(i)
+
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if (tag == binInt && i < 0) || v.OverflowUint(u) {
+				return nil, mismatch()
+			}
+			v.SetUint(u)
+
+		case reflect.Float32, reflect.Float64:
+			if tag == binInt {
+				v.SetFloat(float64(i))
+			} else {
+				v.SetFloat(float64(u))
+			}
+
+		default:
+			return nil, mismatch()
+		}
+		return data[size:], nil
+
+	case binFloat:
+		if len(data) < 8 {
+			return nil, errBinaryShort
+		}
+		if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+			return nil, mismatch()
+		}
+		v.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(data)))
+		return data[8:], nil
+
+	case binStr, binBytes:
+		chunk, rest, err := binaryChunk(data)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(chunk))
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append([]byte(nil), chunk...))
+		case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8 && v.Len() == len(chunk):
+			reflect.Copy(v, reflect.ValueOf(chunk))
+		default:
+			return nil, mismatch()
+		}
+		return rest, nil
+
+	case binList:
+		n, rest, err := binaryUvarint(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(rest)) {
+			// every value takes at least one byte
+			return nil, errBinaryShort
+		}
+
+		switch v.Kind() {
+		case reflect.Slice:
+			v.Set(reflect.MakeSlice(v.Type(), int(n), int(n)))
+		case reflect.Array:
+			if uint64(v.Len()) != n {
+				return nil, mismatch()
+			}
+		default:
+			return nil, mismatch()
+		}
+
+		for i := 0; i < int(n); i++ {
+			if rest, err = binaryDecode(rest, v.Index(i), depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return rest, nil
+
+	case binMap:
+		n, rest, err := binaryUvarint(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(rest)) {
+			return nil, errBinaryShort
+		}
+
+		switch v.Kind() {
+		case reflect.Map:
+			t := v.Type()
+			v.Set(reflect.MakeMapWithSize(t, int(n)))
+
+			for i := 0; i < int(n); i++ {
+				key := reflect.New(t.Key()).Elem()
+				if rest, err = binaryDecode(rest, key, depth+1); err != nil {
+					return nil, err
+				}
+
+				// a list or map decoded into an interface{} key
+				if !key.Comparable() {
+					return nil, errors.New(fmt.Sprintf("binary codec: map key of type %s can't be hashed", key.Elem().Type()))
+				}
+
+				val := reflect.New(t.Elem()).Elem()
+				if rest, err = binaryDecode(rest, val, depth+1); err != nil {
+					return nil, err
+				}
+
+				v.SetMapIndex(key, val)
+			}
+			return rest, nil
+
+		case reflect.Struct:
+			for i := 0; i < int(n); i++ {
+				var name string
+				if rest, err = binaryDecode(rest, reflect.ValueOf(&name).Elem(), depth+1); err != nil {
+					return nil, err
+				}
+
+				f, ok := v.Type().FieldByName(name)
+				if ok && f.IsExported() && len(f.Index) == 1 {
+					rest, err = binaryDecode(rest, v.FieldByIndex(f.Index), depth+1)
+				} else {
+					// unknown field; skip it
+					_, rest, err = binaryDecodeDynamic(rest, depth+1)
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			return rest, nil
+		}
+
+		return nil, mismatch()
+	}
+
+	return nil, errors.New(fmt.Sprintf("binary codec: unknown tag %d", tag))
+}
+
+// Decode one value from data into an empty interface
+func binaryDecodeInterface(data []byte, v reflect.Value, depth int) ([]byte, error) {
+	var dst reflect.Value
+
+	switch data[0] {
+	case binFalse, binTrue:
+		dst = reflect.New(reflect.TypeOf(false))
+	case binInt:
+		dst = reflect.New(reflect.TypeOf(int64(0)))
+	case binUint:
+		dst = reflect.New(reflect.TypeOf(uint64(0)))
+	case binFloat:
+		dst = reflect.New(reflect.TypeOf(float64(0)))
+	case binStr:
+		dst = reflect.New(reflect.TypeOf(""))
+	case binBytes:
+		dst = reflect.New(reflect.TypeOf([]byte(nil)))
+	case binList:
+		dst = reflect.New(reflect.TypeOf([]interface{}(nil)))
+	case binMap:
+		dst = reflect.New(reflect.TypeOf(map[string]interface{}(nil)))
+	default:
+		return nil, errors.New(fmt.Sprintf("binary codec: unknown tag %d", data[0]))
+	}
+
+	rest, err := binaryDecode(data, dst.Elem(), depth)
+	if err != nil {
+		return nil, err
+	}
+
+	v.Set(dst.Elem())
+
+	return rest, nil
+}
@@ -0,0 +1,369 @@
+// Multi-node clustering
+
+package connectionmanager
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kinds of clusterFrame
+const (
+	clusterKindBroadcast = "broadcast"
+	clusterKindUnicast   = "unicast"
+	clusterKindClaim     = "claim"
+	clusterKindHello     = "hello"
+)
+
+// A message passed between cluster nodes
+//
+// The payload is encoded with the codec negotiated with the receiving
+// node, named in Codec.
+type clusterFrame struct {
+	Kind      string
+	Type      MessageType
+	MessageId string
+	Id        string
+	DestId    string
+	Group     string
+	Codec     string
+	Payload   []byte
+	TTL       time.Duration
+	Priority  int
+	Timestamp time.Time
+
+	// for queries and replies
+	CorrelationId string
+	ReplyTo       string
+
+	// for unicasts, how many times the frame has been forwarded
+	Hops int
+
+	// for claims, Id is claimed by node DestId at this version, and
+	// has this public ID if the manager issued it
+	Version  uint64
+	PublicId string
+
+	// for hellos, the codecs node Id can decode, best first
+	Codecs []string
+}
+
+// A message forwarded from another node, passed to the manager in the
+// General field of a clusterUnicast
+type clusterForward[T any] struct {
+	envelope *TypedEnvelope[T]
+
+	// how many times it's been forwarded
+	hops int
+}
+
+// Joins a Manager to other Managers over a Transport, so that a
+// broadcast on any node reaches connections on every node, and a
+// unicast reaches its recipient wherever it's connected
+//
+// Each node claims the connections made to it and tells the others, so
+// every node keeps a directory of where connections live. A connection
+// that moves to another node is handed over, queued messages and all.
+type Cluster[T any] struct {
+	cm        *Manager[T]
+	transport Transport
+	codec     Codec
+
+	lock sync.Mutex
+
+	// latest claim for each connection ID
+	directory map[string]directoryEntry
+
+	// connection IDs by public ID, for claims that carry one
+	publicIds map[string]string
+
+	// Lamport clock for claims
+	clock uint64
+
+	// codecs for payloads sent to each node, negotiated from its hello
+	peerCodecs map[string]Codec
+
+	// closed when the receive goroutine exits
+	done chan struct{}
+}
+
+// Attach a Manager to a cluster over transport, encoding payloads with
+// codec
+//
+// Nodes tell each other the codecs they know when they join, their own
+// codec first, and payloads are sent to each node in the first of its
+// codecs this node also knows, so each node gets its own codec when it
+// can. Until a node says, it gets codec.
+//
+// Must be called before cm.SetActive(true). Frames are received as soon
+// as the Cluster is created.
+func NewCluster[T any](cm *Manager[T], transport Transport, codec Codec) *Cluster[T] {
+	cl := &Cluster[T]{
+		cm:         cm,
+		transport:  transport,
+		codec:      codec,
+		directory:  make(map[string]directoryEntry),
+		publicIds:  make(map[string]string),
+		peerCodecs: make(map[string]Codec),
+		done:       make(chan struct{}),
+	}
+
+	cm.cluster = cl
+
+	go cl.receive()
+
+	return cl
+}
+
+// Add a node to the cluster
+//
+// Broadcasts from this node are queued for the new node from now on,
+// even before it can be reached.
+func (cl *Cluster[T]) Join(node string, addr string) error {
+	if err := cl.transport.AddPeer(node, addr); err != nil {
+		return err
+	}
+
+	if data, err := cl.encodeHello(); err == nil {
+		cl.transport.Send(node, data)
+	}
+
+	cl.sendClaims(node)
+
+	return nil
+}
+
+// Remove a node from the cluster, once it has everything already sent
+// to it
+//
+// Connections it held are forgotten until they are claimed elsewhere.
+func (cl *Cluster[T]) Leave(node string) error {
+	err := cl.transport.RemovePeer(node)
+
+	cl.forgetNode(node)
+
+	cl.lock.Lock()
+	delete(cl.peerCodecs, node)
+	cl.lock.Unlock()
+
+	return err
+}
+
+// Names of the other nodes in the cluster
+func (cl *Cluster[T]) Members() []string {
+	return cl.transport.Peers()
+}
+
+// Leave every node (delivering what's queued for them) and shut the
+// transport down
+func (cl *Cluster[T]) Close() error {
+	for _, node := range cl.transport.Peers() {
+		cl.transport.RemovePeer(node)
+	}
+
+	err := cl.transport.Close()
+	<-cl.done
+
+	return err
+}
+
+// Encode an envelope as a clusterFrame, forwarded hops times so far,
+// with its payload encoded by codec
+func (cl *Cluster[T]) encode(kind string, e *TypedEnvelope[T], hops int, codec Codec) ([]byte, error) {
+	payload, err := codec.Marshal(e.payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&clusterFrame{
+		Kind:      kind,
+		Type:      e.typ,
+		MessageId: e.id,
+		Id:        e.sender,
+		DestId:    e.destId,
+		Group:     e.group,
+		Codec:     codec.Name(),
+		Payload:   payload,
+		TTL:       e.ttl,
+		Priority:  e.priority,
+		Timestamp: e.timestamp,
+		Hops:      hops,
+
+		CorrelationId: e.correlationId,
+		ReplyTo:       e.replyTo,
+	})
+}
+
+// Encode a hello, listing the codecs this node can decode, its own
+// first
+func (cl *Cluster[T]) encodeHello() ([]byte, error) {
+	names := CodecNames()
+	sort.Strings(names)
+
+	codecs := []string{cl.codec.Name()}
+	for _, name := range names {
+		if name != cl.codec.Name() {
+			codecs = append(codecs, name)
+		}
+	}
+
+	return json.Marshal(&clusterFrame{
+		Kind:   clusterKindHello,
+		Id:     cl.transport.Local(),
+		Codecs: codecs,
+	})
+}
+
+// Return the codec for payloads sent to a node
+func (cl *Cluster[T]) peerCodec(node string) Codec {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if c, ok := cl.peerCodecs[node]; ok {
+		return c
+	}
+
+	return cl.codec
+}
+
+// Encode a claim on a connection
+func (cl *Cluster[T]) encodeClaim(id string, e directoryEntry) ([]byte, error) {
+	return json.Marshal(&clusterFrame{
+		Kind:     clusterKindClaim,
+		Id:       id,
+		DestId:   e.node,
+		Version:  e.version,
+		PublicId: e.publicId,
+	})
+}
+
+// Decode a clusterFrame, and the envelope it carries
+func (cl *Cluster[T]) decode(data []byte) (*clusterFrame, *TypedEnvelope[T], error) {
+	var f clusterFrame
+
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, nil, err
+	}
+
+	e := &TypedEnvelope[T]{
+		id:            f.MessageId,
+		typ:           f.Type,
+		sender:        f.Id,
+		destId:        f.DestId,
+		group:         f.Group,
+		correlationId: f.CorrelationId,
+		replyTo:       f.ReplyTo,
+		timestamp:     f.Timestamp,
+		ttl:           f.TTL,
+		priority:      f.Priority,
+	}
+
+	// claims and hellos have no payload
+	if f.Codec != "" {
+		codec, err := CodecByName(f.Codec)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := codec.Unmarshal(f.Payload, &e.payload); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &f, e, nil
+}
+
+// Send a frame to every other node
+//
+// Called from the manager's goroutine; transports queue rather than
+// block. Returns the number of nodes that couldn't be sent to.
+func (cl *Cluster[T]) sendAll(data []byte) int {
+	failed := 0
+
+	for _, node := range cl.transport.Peers() {
+		if err := cl.transport.Send(node, data); err != nil {
+			failed++
+		}
+	}
+
+	return failed
+}
+
+// Pass a broadcast or group publish that started on this node to the
+// other nodes
+//
+// Returns the number of nodes that couldn't be sent to.
+func (cl *Cluster[T]) relayBroadcast(e *TypedEnvelope[T]) int {
+	failed := 0
+
+	// encode once for each codec in use, by name
+	encoded := make(map[string][]byte)
+
+	for _, node := range cl.transport.Peers() {
+		codec := cl.peerCodec(node)
+
+		data, ok := encoded[codec.Name()]
+		if !ok {
+			var err error
+			if data, err = cl.encode(clusterKindBroadcast, e, 0, codec); err != nil {
+				data = nil
+			}
+
+			encoded[codec.Name()] = data
+		}
+
+		if data == nil || cl.transport.Send(node, data) != nil {
+			failed++
+		}
+	}
+
+	return failed
+}
+
+// Hand frames from other nodes to the manager (runs as a goroutine)
+func (cl *Cluster[T]) receive() {
+	defer close(cl.done)
+
+	for frame := range cl.transport.Receive() {
+		f, e, err := cl.decode(frame.Data)
+		if err != nil {
+			continue
+		}
+
+		switch f.Kind {
+		case clusterKindBroadcast:
+			cl.cm.SendMessage(&TypedMessage[T]{
+				Type:    clusterBroadcast,
+				General: e,
+			})
+
+		case clusterKindUnicast:
+			cl.cm.SendMessage(&TypedMessage[T]{
+				Type:    clusterUnicast,
+				General: &clusterForward[T]{envelope: e, hops: f.Hops},
+			})
+
+		case clusterKindHello:
+			// a node we can't speak to at all keeps getting our codec
+			if codec, err := NegotiateCodec(f.Codecs); err == nil {
+				cl.lock.Lock()
+				cl.peerCodecs[f.Id] = codec
+				cl.lock.Unlock()
+			}
+
+		case clusterKindClaim:
+			// a newer claim by another node means any local copy of
+			// the connection has to be handed over
+			e := directoryEntry{node: f.DestId, publicId: f.PublicId, version: f.Version}
+			if cl.record(f.Id, e) && e.node != "" && e.node != cl.transport.Local() {
+				cl.cm.SendMessage(&TypedMessage[T]{
+					Type:   clusterClaim,
+					Id:     f.Id,
+					DestId: e.node,
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package connectionmanager
+
+import (
+	"testing"
+	"time"
+)
+
+// A node of a test cluster
+type testNode struct {
+	cm      *ConnectionManager
+	cluster *Cluster[*MessagePayload]
+}
+
+// Start a manager on a transport, with one connection named after the
+// node
+func startTestNode(t *testing.T, transport Transport) *testNode {
+	cm := New()
+	n := &testNode{cm: cm, cluster: NewCluster(cm, transport, BinaryCodec)}
+
+	cm.SetActive(true)
+	cm.SendMessage(&Message{Type: ConnectRequest, Id: transport.Local()})
+
+	return n
+}
+
+// Poll a node's connection for a single expected message
+func expectText(t *testing.T, n *testNode, id string, text string) {
+	texts := payloadText(pollTest(t, n.cm, &Message{Id: id}))
+	if len(texts) != 1 || texts[0] != text {
+		t.Errorf("%s: expected [%s], got %v", id, text, texts)
+	}
+}
+
+func TestMemoryCluster(t *testing.T) {
+	network := NewMemoryNetwork()
+	names := []string{"a", "b", "c"}
+	nodes := map[string]*testNode{}
+
+	for _, name := range names {
+		transport, err := network.Transport(name)
+		if err != nil {
+			t.Fatalf("Transport: %v", err)
+		}
+		nodes[name] = startTestNode(t, transport)
+	}
+
+	for _, name := range names {
+		for _, peer := range names {
+			if peer != name {
+				nodes[name].cluster.Join(peer, "")
+			}
+		}
+	}
+
+	broadcastTest(t, nodes["a"].cm, &Message{Id: "a"}, "hello")
+
+	for _, name := range names {
+		expectText(t, nodes[name], name, "hello")
+	}
+
+	// after c leaves a's cluster, a's broadcasts don't reach it
+	nodes["a"].cluster.Leave("c")
+	broadcastTest(t, nodes["a"].cm, &Message{Id: "a"}, "bye")
+	broadcastTest(t, nodes["c"].cm, &Message{Id: "c"}, "still here")
+
+	expectText(t, nodes["c"], "c", "still here")
+
+	for _, name := range names {
+		nodes[name].cluster.Close()
+		nodes[name].cm.SetActive(false)
+	}
+}
+
+func TestTCPClusterReconnect(t *testing.T) {
+	ta, err := NewTCPTransport("a", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPTransport: %v", err)
+	}
+	tb, err := NewTCPTransport("b", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPTransport: %v", err)
+	}
+	addrB := tb.Addr().String()
+
+	a := startTestNode(t, ta)
+	b := startTestNode(t, tb)
+	defer a.cm.SetActive(false)
+
+	a.cluster.Join("b", addrB)
+	b.cluster.Join("a", ta.Addr().String())
+
+	broadcastTest(t, a.cm, &Message{Id: "a"}, "one")
+	expectText(t, b, "b", "one")
+
+	// take b down; broadcasts queue up on a until it's back
+	b.cluster.transport.Close()
+	<-b.cluster.done
+	b.cm.SetActive(false)
+
+	broadcastTest(t, a.cm, &Message{Id: "a"}, "two")
+
+	tb, err = NewTCPTransport("b", addrB)
+	if err != nil {
+		t.Skipf("couldn't reuse %s: %v", addrB, err)
+	}
+	b = startTestNode(t, tb)
+	defer b.cm.SetActive(false)
+
+	// a redials within tcpRedialDelay, well inside the poll timeout
+	expectText(t, b, "b", "two")
+
+	a.cluster.Close()
+	b.cluster.Close()
+}
+
+func TestTCPTransportSecret(t *testing.T) {
+	ta, err := NewTCPTransport("a", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPTransport: %v", err)
+	}
+	defer ta.Close()
+	tb, err := NewTCPTransport("b", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPTransport: %v", err)
+	}
+	defer tb.Close()
+
+	ta.SetSecret([]byte("open sesame"))
+	tb.SetSecret([]byte("something else"))
+
+	ta.AddPeer("b", tb.Addr().String())
+	ta.Send("b", []byte("hello"))
+
+	// b turns a away
+	select {
+	case f := <-tb.Receive():
+		t.Fatalf("received %q with the wrong secret", f.Data)
+	case <-time.After(3 * tcpRedialDelay):
+	}
+
+	// a's next attempt gets through once the secrets match
+	tb.SetSecret([]byte("open sesame"))
+
+	select {
+	case f := <-tb.Receive():
+		if f.From != "a" || string(f.Data) != "hello" {
+			t.Fatalf("received %q from %s", f.Data, f.From)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("frame never arrived")
+	}
+}
+
+func TestTCPTransportPendingLimit(t *testing.T) {
+	ta, err := NewTCPTransport("a", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPTransport: %v", err)
+	}
+	defer ta.Close()
+
+	// an address nothing is listening on
+	tb, err := NewTCPTransport("b", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPTransport: %v", err)
+	}
+	addrB := tb.Addr().String()
+	tb.Close()
+
+	ta.AddPeer("b", addrB)
+
+	frame := make([]byte, tcpMaxPending/4)
+	for i := 0; i < 4; i++ {
+		if err := ta.Send("b", frame); err != nil {
+			t.Fatalf("Send %d: %v", i, err)
+		}
+	}
+
+	if err := ta.Send("b", []byte("one too many")); err == nil {
+		t.Fatalf("Send past tcpMaxPending succeeded")
+	}
+}
+
+// Wait for a cluster's directory to show a connection's owner
+func waitForOwner(t *testing.T, n *testNode, id string, node string) {
+	deadline := time.Now().Add(2 * time.Second)
+
+	for n.cluster.owner(id) != node {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never owned by %s", id, node)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Send a unicast with a single "text" payload
+func unicastTest(t *testing.T, cm *ConnectionManager, from, to, text string) {
+	resp := cm.SendMessage(&Message{
+		Type:    UnicastRequest,
+		Id:      from,
+		DestId:  to,
+		Payload: &MessagePayload{"text": text},
+	})
+
+	if resp.Err != nil {
+		t.Fatalf("UnicastRequest %q: %v", text, resp.Err)
+	}
+}
+
+func TestClusterDirectory(t *testing.T) {
+	network := NewMemoryNetwork()
+	ta, _ := network.Transport("a")
+	tb, _ := network.Transport("b")
+
+	a := startTestNode(t, ta)
+	b := startTestNode(t, tb)
+	defer a.cm.SetActive(false)
+	defer b.cm.SetActive(false)
+
+	a.cluster.Join("b", "")
+	b.cluster.Join("a", "")
+
+	a.cm.SendMessage(&Message{Type: ConnectRequest, Id: "alice"})
+	waitForOwner(t, b, "alice", "a")
+
+	// a unicast on b is forwarded to a
+	unicastTest(t, b.cm, "b", "alice", "forwarded")
+	expectText(t, a, "alice", "forwarded")
+
+	// when alice polls on b, her queue and groups move over from a
+	a.cm.SendMessage(&Message{Type: SubscribeRequest, Id: "alice", Group: "rabbits"})
+	unicastTest(t, a.cm, "a", "alice", "queued")
+	expectText(t, b, "alice", "queued")
+
+	waitForOwner(t, a, "alice", "b")
+
+	publishTest(t, a.cm, "rabbits", "hop")
+	expectText(t, b, "alice", "hop")
+
+	// and unicasts on a now go to b
+	unicastTest(t, a.cm, "a", "alice", "moved")
+	expectText(t, b, "alice", "moved")
+
+	// unknown IDs are still errors
+	resp := a.cm.SendMessage(&Message{Type: UnicastRequest, Id: "a", DestId: "nobody"})
+	if resp.Err == nil {
+		t.Errorf("expected error for unicast to unknown id")
+	}
+
+	a.cluster.Close()
+	b.cluster.Close()
+}
+
+func TestClusterDisconnect(t *testing.T) {
+	network := NewMemoryNetwork()
+	ta, _ := network.Transport("a")
+	tb, _ := network.Transport("b")
+
+	a := startTestNode(t, ta)
+	b := startTestNode(t, tb)
+	defer a.cm.SetActive(false)
+	defer b.cm.SetActive(false)
+
+	a.cluster.Join("b", "")
+	b.cluster.Join("a", "")
+
+	a.cm.SendMessage(&Message{Type: ConnectRequest, Id: "alice"})
+	waitForOwner(t, b, "alice", "a")
+
+	resp := a.cm.SendMessage(&Message{Type: DisconnectRequest, Id: "alice"})
+	if resp.Err != nil {
+		t.Fatalf("DisconnectRequest: %v", resp.Err)
+	}
+	waitForOwner(t, b, "alice", "")
+
+	// a disconnected connection can't be brought back by polling
+	// on either node
+	for _, n := range []*testNode{a, b} {
+		resp = n.cm.SendMessage(&Message{Type: PollRequest, Id: "alice"})
+		if resp.Err == nil {
+			t.Errorf("expected error polling after disconnect")
+		}
+	}
+
+	a.cluster.Close()
+	b.cluster.Close()
+}
+
+func TestClusterPublicIds(t *testing.T) {
+	network := NewMemoryNetwork()
+	ta, _ := network.Transport("a")
+	tb, _ := network.Transport("b")
+
+	a := startTestNode(t, ta)
+	b := startTestNode(t, tb)
+	defer a.cm.SetActive(false)
+	defer b.cm.SetActive(false)
+
+	a.cluster.Join("b", "")
+	b.cluster.Join("a", "")
+
+	resp := a.cm.SendMessage(&Message{Type: ConnectRequest})
+	if resp.Err != nil {
+		t.Fatalf("ConnectRequest: %v", resp.Err)
+	}
+	id, publicId := resp.Id, resp.PublicId
+	waitForOwner(t, b, id, "a")
+
+	// unicasts to the public ID find the connection on another node
+	unicastTest(t, b.cm, "b", publicId, "there")
+	expectText(t, a, id, "there")
+
+	// and once it has moved to b, it's still known by its public ID
+	pollTest(t, b.cm, &Message{Id: id, Timeout: time.Millisecond})
+	waitForOwner(t, a, id, "b")
+
+	broadcastTest(t, b.cm, &Message{Id: id}, "moved")
+	batch := pollTest(t, b.cm, &Message{Id: "b"})
+	if len(batch) != 1 || batch[0].Sender() != publicId {
+		t.Errorf("expected a message from %s, got %v", publicId, batch)
+	}
+	expectText(t, b, id, "moved")
+
+	unicastTest(t, a.cm, "a", publicId, "still there")
+	expectText(t, b, id, "still there")
+
+	a.cluster.Close()
+	b.cluster.Close()
+}
+
+func TestClusterCodecNegotiation(t *testing.T) {
+	network := NewMemoryNetwork()
+	ta, _ := network.Transport("a")
+	tb, _ := network.Transport("b")
+
+	a := startTestNode(t, ta)
+	defer a.cm.SetActive(false)
+
+	cm := New()
+	b := &testNode{cm: cm, cluster: NewCluster(cm, tb, GobCodec)}
+	cm.SetActive(true)
+	cm.SendMessage(&Message{Type: ConnectRequest, Id: "b"})
+	defer cm.SetActive(false)
+
+	a.cluster.Join("b", "")
+	b.cluster.Join("a", "")
+
+	// each sends the other what it prefers
+	deadline := time.Now().Add(2 * time.Second)
+	for a.cluster.peerCodec("b") != GobCodec || b.cluster.peerCodec("a") != BinaryCodec {
+		if time.Now().After(deadline) {
+			t.Fatalf("codecs never negotiated: %s %s", a.cluster.peerCodec("b").Name(), b.cluster.peerCodec("a").Name())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	broadcastTest(t, a.cm, &Message{Id: "a"}, "hello")
+	expectText(t, b, "b", "hello")
+
+	a.cluster.Close()
+	b.cluster.Close()
+}
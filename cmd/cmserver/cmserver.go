@@ -0,0 +1,85 @@
+// Standalone server exposing a ConnectionManager over line-delimited
+// JSON on TCP and Unix sockets
+package main
+
+import (
+	"fmt"
+	"github.com/beejjorgensen/connectionmanager"
+	"launchpad.net/gnuflag"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// command line options
+var tcpAddr string
+var unixPath string
+
+// usage message
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [-t addr] [-u path]\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "   -t addr    TCP address to listen on, e.g. :7070\n")
+	fmt.Fprintf(os.Stderr, "   -u path    Unix socket to listen on\n")
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "At least one of -t and -u is required.\n")
+}
+
+// exit with an error message and status
+func errorExit(s string, status int) {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", filepath.Base(os.Args[0]), s)
+	os.Exit(status)
+}
+
+// Listen on a Unix socket, replacing one left behind by an earlier run
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	return net.Listen("unix", path)
+}
+
+// main
+func main() {
+	gnuflag.Usage = usage
+
+	gnuflag.StringVar(&tcpAddr, "t", "", "TCP address to listen on")
+	gnuflag.StringVar(&unixPath, "u", "", "Unix socket to listen on")
+
+	gnuflag.Parse(true)
+
+	if tcpAddr == "" && unixPath == "" {
+		usage()
+		os.Exit(1)
+	}
+
+	cm := connectionmanager.New()
+	cm.SetActive(true)
+
+	server := connectionmanager.NewLineServer(cm)
+	errs := make(chan error)
+
+	if tcpAddr != "" {
+		listener, err := net.Listen("tcp", tcpAddr)
+		if err != nil {
+			errorExit(fmt.Sprintf("%s: %v", tcpAddr, err), 2)
+		}
+
+		log.Printf("Listening on %s", listener.Addr())
+		go func() { errs <- server.Serve(listener) }()
+	}
+
+	if unixPath != "" {
+		listener, err := listenUnix(unixPath)
+		if err != nil {
+			errorExit(fmt.Sprintf("%s: %v", unixPath, err), 2)
+		}
+
+		log.Printf("Listening on %s", unixPath)
+		go func() { errs <- server.Serve(listener) }()
+	}
+
+	log.Fatal(<-errs)
+}
@@ -0,0 +1,137 @@
+// Payload codecs for messages that leave the process
+
+package connectionmanager
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Encodes and decodes message payloads when they cross a process
+// boundary (storage, clustering, network front ends)
+//
+// Codecs must be safe for concurrent use.
+type Codec interface {
+	// Name used to negotiate the codec on a transport
+	Name() string
+
+	// Encode v
+	Marshal(v interface{}) ([]byte, error)
+
+	// Decode data into the value pointed to by v
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Codec using encoding/json
+var JSONCodec Codec = jsonCodec{}
+
+// Codec using encoding/gob
+var GobCodec Codec = gobCodec{}
+
+// Compact self-describing binary Codec (see BinaryCodec's Marshal for
+// the format)
+var BinaryCodec Codec = binaryCodec{}
+
+// Registered codecs, by name
+var codecs = map[string]Codec{
+	JSONCodec.Name():   JSONCodec,
+	GobCodec.Name():    GobCodec,
+	BinaryCodec.Name(): BinaryCodec,
+}
+
+// Protects codecs
+var codecsLock sync.RWMutex
+
+func init() {
+	// let map payloads nest inside interface values under gob
+	gob.Register(MessagePayload{})
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// Make a codec available to CodecByName() and NegotiateCodec(),
+// replacing any codec of the same name
+func RegisterCodec(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	codecs[c.Name()] = c
+}
+
+// Look up a registered codec
+func CodecByName(name string) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	c, ok := codecs[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown codec: %s", name))
+	}
+
+	return c, nil
+}
+
+// Pick the first codec in a peer's preference list that we know
+//
+// An empty list means the peer doesn't negotiate, and gets JSONCodec.
+func NegotiateCodec(offered []string) (Codec, error) {
+	if len(offered) == 0 {
+		return JSONCodec, nil
+	}
+
+	for _, name := range offered {
+		if c, err := CodecByName(name); err == nil {
+			return c, nil
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("no common codec in %v", offered))
+}
+
+// Return the names of all registered codecs
+func CodecNames() []string {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	r := make([]string, 0, len(codecs))
+	for name := range codecs {
+		r = append(r, name)
+	}
+
+	return r
+}
+
+// Codec using encoding/json (implements Codec)
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// Codec using encoding/gob (implements Codec)
+//
+// Each value is a self-contained gob stream, so it carries its own type
+// information.
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,151 @@
+package connectionmanager
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, GobCodec, BinaryCodec} {
+		in := &MessagePayload{
+			"type":  "message",
+			"text":  "hello",
+			"flags": []interface{}{"a", true},
+			"user":  map[string]interface{}{"name": "alpha"},
+		}
+
+		data, err := codec.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s: Marshal: %v", codec.Name(), err)
+		}
+
+		var out *MessagePayload
+		if err := codec.Unmarshal(data, &out); err != nil {
+			t.Fatalf("%s: Unmarshal: %v", codec.Name(), err)
+		}
+
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("%s: expected %v, got %v", codec.Name(), *in, *out)
+		}
+	}
+}
+
+func TestBinaryCodecStruct(t *testing.T) {
+	type inner struct {
+		Tags []string
+	}
+	type payload struct {
+		Count  int
+		Ratio  float64
+		When   time.Time
+		Inner  *inner
+		Extra  map[string]uint16
+		hidden string
+	}
+
+	in := payload{
+		Count: -42,
+		Ratio: 0.5,
+		When:  time.Date(2012, 10, 9, 12, 0, 0, 0, time.UTC),
+		Inner: &inner{Tags: []string{"x", "y"}},
+		Extra: map[string]uint16{"port": 8080},
+	}
+
+	data, err := BinaryCodec.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var out payload
+	if err := BinaryCodec.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	if !out.When.Equal(in.When) {
+		t.Errorf("When: expected %v, got %v", in.When, out.When)
+	}
+	out.When = in.When
+
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("expected %+v, got %+v", in, out)
+	}
+
+	// truncated data is an error, not a panic
+	for i := 0; i < len(data); i++ {
+		if err := BinaryCodec.Unmarshal(data[:i], &out); err == nil {
+			t.Errorf("no error decoding %d of %d bytes", i, len(data))
+		}
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	c, err := NegotiateCodec([]string{"msgpack", "binary", "json"})
+	if err != nil || c.Name() != "binary" {
+		t.Errorf("expected binary, got %v %v", c, err)
+	}
+
+	c, err = NegotiateCodec(nil)
+	if err != nil || c != JSONCodec {
+		t.Errorf("expected json default, got %v %v", c, err)
+	}
+
+	if _, err = NegotiateCodec([]string{"msgpack"}); err == nil {
+		t.Errorf("expected error for unknown codec")
+	}
+}
+
+func TestBinaryCodecDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		var data []byte
+		for i := 0; i < depth; i++ {
+			data = append(data, binList, 1)
+		}
+		return append(data, binNil)
+	}
+
+	var v interface{}
+	if err := BinaryCodec.Unmarshal(nested(10), &v); err != nil {
+		t.Errorf("Unmarshal 10 deep: %v", err)
+	}
+
+	// too deep is an error, not a stack overflow
+	if err := BinaryCodec.Unmarshal(nested(1000000), &v); err == nil {
+		t.Errorf("expected error decoding a million nested lists")
+	}
+
+	// as is encoding a value that contains itself
+	loop := map[string]interface{}{}
+	loop["self"] = loop
+	if _, err := BinaryCodec.Marshal(loop); err == nil {
+		t.Errorf("expected error encoding a map that contains itself")
+	}
+
+	var self interface{}
+	self = &self
+	if _, err := BinaryCodec.Marshal(self); err == nil {
+		t.Errorf("expected error encoding a pointer to itself")
+	}
+}
+
+func TestBinaryCodecArrays(t *testing.T) {
+	in := struct{ Id [4]byte }{[4]byte{1, 2, 3, 4}}
+
+	data, err := BinaryCodec.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var out struct{ Id [4]byte }
+	if err := BinaryCodec.Unmarshal(data, &out); err != nil || out != in {
+		t.Errorf("expected %v, got %v %v", in, out, err)
+	}
+
+	// a list can't be a key, but that's an error, not a panic
+	data = []byte{binMap, 1, binList, 0, binNil}
+
+	var m map[interface{}]interface{}
+	if err := BinaryCodec.Unmarshal(data, &m); err == nil {
+		t.Errorf("expected error decoding a list as a map key")
+	}
+}
@@ -3,9 +3,12 @@
 package connectionmanager
 
 import (
-	"container/list"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"sort"
+	"time"
 	//"log"
 )
 
@@ -13,15 +16,68 @@ import (
 type MessageType int32
 
 const (
-	StopRequest       MessageType = 0
-	StopResponse      MessageType = 1
-	ConnectRequest    MessageType = 2
-	ConnectResponse   MessageType = 3
-	BroadcastRequest  MessageType = 4
-	BroadcastResponse MessageType = 5
-	PollRequest       MessageType = 6
-	PollResponse      MessageType = 7
-	Broadcast         MessageType = 8
+	StopRequest         MessageType = 0
+	StopResponse        MessageType = 1
+	ConnectRequest      MessageType = 2
+	ConnectResponse     MessageType = 3
+	BroadcastRequest    MessageType = 4
+	BroadcastResponse   MessageType = 5
+	PollRequest         MessageType = 6
+	PollResponse        MessageType = 7
+	Broadcast           MessageType = 8
+	StatsRequest        MessageType = 9
+	StatsResponse       MessageType = 10
+	UnicastRequest      MessageType = 11
+	UnicastResponse     MessageType = 12
+	Unicast             MessageType = 13
+	ScheduleRequest     MessageType = 14
+	ScheduleResponse    MessageType = 15
+	CancelRequest       MessageType = 16
+	CancelResponse      MessageType = 17
+	ScheduledRequest    MessageType = 18
+	ScheduledResponse   MessageType = 19
+	SubscribeRequest    MessageType = 20
+	SubscribeResponse   MessageType = 21
+	UnsubscribeRequest  MessageType = 22
+	UnsubscribeResponse MessageType = 23
+	PublishRequest      MessageType = 24
+	PublishResponse     MessageType = 25
+	Publish             MessageType = 26
+	DisconnectRequest   MessageType = 27
+	DisconnectResponse  MessageType = 28
+	QueryRequest        MessageType = 29
+	QueryResponse       MessageType = 30
+	Query               MessageType = 31
+	ReplyRequest        MessageType = 32
+	ReplyResponse       MessageType = 33
+	Reply               MessageType = 34
+	DeadLettersRequest  MessageType = 35
+	DeadLettersResponse MessageType = 36
+	RequeueRequest      MessageType = 37
+	RequeueResponse     MessageType = 38
+	PurgeRequest        MessageType = 39
+	PurgeResponse       MessageType = 40
+	LookupRequest       MessageType = 41
+	LookupResponse      MessageType = 42
+	AbandonRequest      MessageType = 43
+	AbandonResponse     MessageType = 44
+)
+
+// Message types the ConnectionManager sends itself
+const (
+	lingerTimeout MessageType = -1
+	pollTimeout   MessageType = -2
+
+	// sent by a Cluster
+	clusterBroadcast MessageType = -3
+	clusterUnicast   MessageType = -4
+	clusterClaim     MessageType = -5
+
+	// sent by a RedisBackplane
+	backplanePublish MessageType = -6
+
+	// sent by a query's timer
+	queryTimeout MessageType = -7
 )
 
 // This dictates how many reentrant calls to SendRequest() can be made
@@ -30,26 +86,116 @@ const (
 // call). I would not expect more than 3 in normal usage.
 const messageChannelSize = 50
 
+// How often the ConnectionManager sweeps all connections for expired
+// messages. Expired messages are also pruned lazily at poll time, so
+// this only bounds how long dead messages take up memory.
+const expireInterval = 10 * time.Second
+
+// How long a session can go without polling before it's forgotten
+const sessionIdleTimeout = 5 * time.Minute
+
+// How many delivered messages each session remembers, so a poller that
+// lost a batch can have it sent again
+const sessionHistoryLength = 100
+
 // Information about a particular connection
-type Connection struct {
+type Connection[T any] struct {
 	// unique ID (UUID-ish) associated with this connection
 	id string
 
-	// channel for receiving messages for this connection
-	pollChannel chan *[]*Message
+	// ID shown to other connections in place of id, if the manager
+	// issued them
+	publicId string
+
+	// polling sessions (one per device or tab), by session ID
+	sessions map[string]*session[T]
+
+	// messages queued while the connection has no sessions; the first
+	// session to poll takes these over
+	backlog *messageQueue[T]
+
+	// default time-to-live for queued messages (0 means forever)
+	defaultTTL time.Duration
+
+	// groups this connection is subscribed to
+	groups map[string]bool
 
-	// true if the connection is polling 
+	// sequence number of the last message queued
+	seq uint64
+
+	// manager-wide count of queued bytes
+	queued *int
+
+	// manager's dead-letter queue
+	dead *deadLetterQueue[T]
+}
+
+// One poller of a Connection, with its own poll slot and queue
+type session[T any] struct {
+	// session ID, unique within the connection
+	id string
+
+	// channel for receiving messages for this session
+	pollChannel chan *[]*TypedEnvelope[T]
+
+	// true if the session is polling
 	polling bool
 
-	// undelivered messages
-	messages *list.List
+	// batch limits for the current poll
+	maxMessages int
+	maxBytes    int
+	linger      time.Duration
+
+	// running while the current poll lingers for more messages
+	lingerTimer *time.Timer
+
+	// true once the current poll has finished lingering
+	lingered bool
+
+	// running while the current poll has a deadline
+	pollTimer *time.Timer
+
+	// messages not yet delivered to this session
+	messages *messageQueue[T]
+
+	// when this session last polled
+	lastPoll time.Time
+
+	// the latest messages delivered, oldest first
+	history []*TypedEnvelope[T]
+
+	// the last batch sent and the queued messages it was made from,
+	// so it can be put back if its poller goes away without it
+	sent       *[]*TypedEnvelope[T]
+	sentQueued []*queuedMessage[T]
+}
+
+// Counters kept by the ConnectionManager, returned in the General
+// field of a StatsResponse
+type Stats struct {
+	// number of queued messages dropped because their TTL ran out
+	Expired uint64
+
+	// number of queued messages shed because a queue was full
+	Dropped uint64
+
+	// number of times a message or claim couldn't be passed to a
+	// cluster node or backplane
+	RelayFailed uint64
+
+	// number of requests refused for being over a rate limit
+	Throttled uint64
 }
 
 // Message payload for Message struct
 type MessagePayload map[string]interface{}
 
-// Messages to and from the ConnectionManager
-type Message struct {
+// Requests to and responses from the ConnectionManager, carrying
+// payloads of the manager's payload type T
+//
+// Connections never receive these: what they're sent arrives as a
+// TypedEnvelope.
+type TypedMessage[T any] struct {
 	// Type of message
 	Type MessageType
 
@@ -59,99 +205,561 @@ type Message struct {
 	// ID of recipient
 	DestId string
 
+	// Public ID of a connection whose ID the manager issued, returned
+	// in the ConnectResponse. Set on a LookupRequest to find the
+	// connection's ID.
+	PublicId string
+
+	// Signed token for the connection, returned in the ConnectResponse
+	// when the manager has a TokenSigner
+	Token string
+
 	// Additional payload to be passed to recipient (or broadcast)
-	Payload *MessagePayload
+	Payload T
+
+	// Time-to-live for this message once queued. Zero uses the
+	// recipient connection's default. On a ConnectRequest this sets
+	// the connection's default.
+	TTL time.Duration
+
+	// Delivery priority. Higher priorities are delivered first and
+	// shed last; messages of equal priority are delivered in order.
+	Priority int
+
+	// Session of the connection making a PollRequest or
+	// AbandonRequest. Every session of a connection receives its own
+	// copy of each message.
+	Session string
+
+	// On a PollRequest, the Seq of the last envelope the poller
+	// received; anything the session was sent after it is delivered
+	// again
+	Seq uint64
+
+	// Group for a SubscribeRequest, UnsubscribeRequest or
+	// PublishRequest
+	Group string
+
+	// Delivery time for a ScheduleRequest
+	At time.Time
+
+	// Batch limits for a PollRequest: the most messages and payload
+	// bytes to deliver at once (0 means unlimited), and how long to
+	// wait for more messages once the first one arrives
+	MaxMessages int
+	MaxBytes    int
+	Linger      time.Duration
+
+	// How long a PollRequest may wait before it's completed with an
+	// empty batch (0 means forever), or a QueryRequest for its reply
+	// (0 means 30 seconds)
+	Timeout time.Duration
+
+	// Matches a Reply to its Query
+	CorrelationId string
+
+	// Connection a Query's reply goes to
+	ReplyTo string
+
+	// Client-chosen key identifying a BroadcastRequest,
+	// UnicastRequest, PublishRequest or ScheduleRequest, so that a
+	// retry isn't handled twice
+	IdempotencyKey string
+
+	// encoded payload size, once the manager has measured it
+	size  int
+	sized bool
 
 	// Channel for response
-	RChan chan *Message
+	RChan chan *TypedMessage[T]
 
-	// Channel for polling
-	PollChan chan *[]*Message
+	// Channel for polling, returned in the PollResponse. Set on an
+	// AbandonRequest to give up that poll.
+	PollChan chan *[]*TypedEnvelope[T]
+
+	// Channel for a QueryRequest's reply, if the asker waits for it
+	ReplyChan chan *TypedMessage[T]
+
+	// The reply, in a QueryResponse sent on ReplyChan
+	Envelope *TypedEnvelope[T]
 
 	// Generic field for data passing
 	General interface{}
 
+	// The caller's credentials, passed to the manager's Authorizer
+	Credentials interface{}
+
 	// Status for SendMessage return
 	Err error
 }
 
-// Manages connections
-type ConnectionManager struct {
+// Messages with map payloads, as used by ConnectionManager
+type Message = TypedMessage[*MessagePayload]
+
+// Manages connections whose messages carry payloads of type T
+type Manager[T any] struct {
 	// list of connections
-	connection map[string]*Connection
+	connection map[string]*Connection[T]
+
+	// IDs of connections by public ID, for those the manager issued
+	publicIds map[string]string
 
 	// the ConnectionManager's incoming message channel
-	messageChannel chan *Message
+	messageChannel chan *TypedMessage[T]
 
 	// true if the handler routine is running
 	active bool
+
+	// maximum messages queued per connection (0 means unlimited)
+	queueLimit int
+
+	// messages waiting for their delivery time
+	schedule scheduleHeap[T]
+
+	// scheduled messages by ID
+	scheduled map[string]*scheduledMessage[T]
+
+	// queries waiting for replies, by correlation ID
+	queries map[string]*pendingQuery[T]
+
+	// messages held for IDs that haven't connected, and how many
+	holdLimits HoldLimits
+	held       map[string]*messageQueue[T]
+	heldCount  int
+
+	// messages that were never delivered
+	deadLetters deadLetterQueue[T]
+
+	// results of recent requests, by sender and idempotency key
+	idempotent        map[idempotencyKey]*idempotentResult[T]
+	idempotencyWindow time.Duration
+
+	// fires when the earliest scheduled message is due
+	scheduleTimer *time.Timer
+
+	// persistent storage, if any
+	store Store
+
+	// encodes payloads for storage and size limits
+	codec Codec
+
+	// connection IDs subscribed to each group
+	groups map[string]map[string]bool
+
+	// cluster this manager belongs to, if any
+	cluster *Cluster[T]
+
+	// Redis backplane, if any
+	backplane *RedisBackplane[T]
+
+	// consulted before handling requests, if set
+	authorizer Authorizer[T]
+
+	// issues and checks connection tokens, if set
+	tokenSigner *TokenSigner
+
+	// hard limits
+	quotas Quotas
+
+	// bytes queued across all connections, counted when
+	// quotas.MaxQueuedBytes is set
+	queuedBytes int
+
+	// rate limits by message type, and each sender's buckets
+	rateLimits map[MessageType]RateLimit
+	buckets    map[rateKey]*tokenBucket
+
+	// counters
+	stats Stats
+}
+
+// A Manager for map payloads
+type ConnectionManager = Manager[*MessagePayload]
+
+// Queue a message for every session of a connection, stamping it with
+// an expiry time
+//
+// size is the message's encoded payload size, or -1 if it hasn't been
+// measured. Returns the number of messages shed to stay under limit.
+func (c *Connection[T]) enqueue(e *TypedEnvelope[T], now time.Time, limit int, size int) int {
+	c.seq++
+	q := &queuedMessage[T]{message: e, size: size, seq: c.seq}
+
+	if size > 0 {
+		q.counted = size
+	}
+
+	ttl := e.ttl
+	if ttl == 0 {
+		ttl = c.defaultTTL
+	}
+
+	if ttl > 0 {
+		q.expires = now.Add(ttl)
+	}
+
+	if len(c.sessions) == 0 {
+		c.backlog.insert(q)
+
+		lost := c.backlog.shed(limit)
+		c.dead.addQueued(lost, DeadLetterDropped, c.id, "")
+
+		return len(lost)
+	}
+
+	dropped := 0
+
+	for _, s := range c.sessions {
+		s.messages.insert(q)
+
+		lost := s.messages.shed(limit)
+		c.dead.addQueued(lost, DeadLetterDropped, c.id, s.id)
+		dropped += len(lost)
+	}
+
+	return dropped
+}
+
+// Remove expired messages from all of a connection's queues, and
+// forget sessions that have stopped polling
+//
+// Returns the number of messages expired.
+func (c *Connection[T]) expire(now time.Time) int {
+	lost := c.backlog.expire(now)
+	c.dead.addQueued(lost, DeadLetterExpired, c.id, "")
+
+	count := len(lost)
+
+	for id, s := range c.sessions {
+		lost := s.messages.expire(now)
+		c.dead.addQueued(lost, DeadLetterExpired, c.id, s.id)
+
+		count += len(lost)
+
+		if !s.polling && now.Sub(s.lastPoll) > sessionIdleTimeout {
+			delete(c.sessions, id)
+
+			// the last session's undelivered messages wait for
+			// whoever polls next
+			if len(c.sessions) == 0 {
+				c.backlog = s.messages
+			} else {
+				s.messages.discard()
+			}
+		}
+	}
+
+	return count
 }
 
-// Check if a connection is polling, and send responses
-func (c *Connection) pollCheck() {
-	l := c.messages.Len()
-	if c.polling && l > 0 {
+// Return every message not yet delivered to all sessions, each once,
+// highest priority first
+func (c *Connection[T]) undelivered() []*queuedMessage[T] {
+	var r []*queuedMessage[T]
+	seen := make(map[*queuedMessage[T]]bool)
+
+	queues := []*messageQueue[T]{c.backlog}
+	for _, s := range c.sessions {
+		queues = append(queues, s.messages)
+	}
+
+	for _, mq := range queues {
+		for e := mq.Front(); e != nil; e = e.Next() {
+			q := e.Value.(*queuedMessage[T])
+			if !seen[q] {
+				seen[q] = true
+				r = append(r, q)
+			}
+		}
+	}
+
+	sort.SliceStable(r, func(i, j int) bool {
+		return r[i].message.priority > r[j].message.priority
+	})
+
+	return r
+}
+
+// Return how many queues a message for the connection goes in
+func (c *Connection[T]) queues() int {
+	if len(c.sessions) == 0 {
+		return 1
+	}
+
+	return len(c.sessions)
+}
+
+// Find or create a session for polling
+func (c *Connection[T]) session(id string) *session[T] {
+	s, ok := c.sessions[id]
+
+	if !ok {
+		s = &session[T]{
+			id:       id,
+			messages: newMessageQueue[T](c.queued),
+		}
+
+		// the first session gets everything queued so far
+		if len(c.sessions) == 0 {
+			s.messages = c.backlog
+			c.backlog = newMessageQueue[T](c.queued)
+		}
+
+		c.sessions[id] = s
+	}
+
+	return s
+}
+
+// Remove expired messages from all connections
+func (cm *Manager[T]) expireAll() {
+	now := time.Now()
+
+	for _, c := range cm.connection {
+		cm.stats.Expired += uint64(c.expire(now))
+	}
+
+	cm.stats.Expired += uint64(cm.expireHeld(now))
+	cm.pruneBuckets(now)
+	cm.pruneIdempotent(now)
+}
+
+// Add delivered messages to a session's history
+func (s *session[T]) remember(messages []*TypedEnvelope[T]) {
+	s.history = append(s.history, messages...)
+
+	if n := len(s.history) - sessionHistoryLength; n > 0 {
+		s.history = append([]*TypedEnvelope[T](nil), s.history[n:]...)
+	}
+}
+
+// Return the messages a session was sent after the one numbered seq,
+// or nil if it doesn't remember that one
+func (s *session[T]) sentAfter(seq uint64) []*TypedEnvelope[T] {
+	for i := len(s.history) - 1; i >= 0; i-- {
+		if s.history[i].seq == seq {
+			return s.history[i+1:]
+		}
+	}
+
+	return nil
+}
+
+// Stop lingering for the current poll
+func (s *session[T]) stopLinger() {
+	if s.lingerTimer != nil {
+		s.lingerTimer.Stop()
+		s.lingerTimer = nil
+	}
+}
+
+// Stop the timers for the current poll
+func (s *session[T]) stopPollTimers() {
+	s.stopLinger()
+
+	if s.pollTimer != nil {
+		s.pollTimer.Stop()
+		s.pollTimer = nil
+	}
+}
+
+// Queue a message for a connection and push it to polling sessions
+//
+// Requests are checked against MaxQueuedBytes before they're handled,
+// but messages from other nodes and the schedule are only checked
+// here. Returns a *QueuedBytesError if the message isn't queued.
+func (cm *Manager[T]) deliver(c *Connection[T], e *TypedEnvelope[T]) error {
+	size := -1
+	if cm.quotas.MaxQueuedBytes > 0 {
+		size = cm.envelopeSize(e)
+
+		if err := cm.checkQueued(size * c.queues()); err != nil {
+			return err
+		}
+	}
+
+	cm.stats.Dropped += uint64(c.enqueue(e, time.Now(), cm.queueLimit, size))
+
+	for _, s := range c.sessions {
+		cm.pollCheck(c, s)
+	}
+
+	return nil
+}
+
+// Check if a session is polling, and send responses
+//
+// Expired messages are pruned before anything is sent. If the poll
+// asked to linger, the batch is held back until the linger time is up
+// or the batch is full.
+func (cm *Manager[T]) pollCheck(c *Connection[T], s *session[T]) {
+	if !s.polling {
+		return
+	}
+
+	lost := s.messages.expire(time.Now())
+	cm.deadLetters.addQueued(lost, DeadLetterExpired, c.id, s.id)
+	cm.stats.Expired += uint64(len(lost))
+
+	if s.messages.Len() == 0 {
+		return
+	}
+
+	batch := s.messages.nextBatch(s.maxMessages, s.maxBytes, cm.codec)
+
+	if s.linger > 0 && !s.lingered && len(batch) == s.messages.Len() {
+		// more would fit, so wait for them
+		if s.lingerTimer == nil {
+			pollChannel := s.pollChannel
+			s.lingerTimer = time.AfterFunc(s.linger, func() {
+				cm.messageChannel <- &TypedMessage[T]{
+					Type:     lingerTimeout,
+					Id:       c.id,
+					Session:  s.id,
+					PollChan: pollChannel,
+				}
+			})
+		}
+
+		return
+	}
+
+	l := len(batch)
+	if l > 0 {
+		s.stopPollTimers()
+
 		// Array for passing messages to poller
 		// (poller will own)
-		messageArray := make([]*Message, l)
-
-		// make new references to the data
-		count := 0
-		for e := c.messages.Front(); e != nil; e = e.Next() {
-			messageArray[count] = e.Value.(*Message)
-			count++
+		messageArray := make([]*TypedEnvelope[T], l)
+		sentQueued := make([]*queuedMessage[T], l)
+
+		// copy the messages (they're shared between connections) to
+		// stamp them with their sequence numbers, and ditch sent
+		// messages
+		for i, e := range batch {
+			sentQueued[i] = e.Value.(*queuedMessage[T])
+			messageArray[i] = sentQueued[i].delivered()
+			s.messages.Remove(e)
 		}
 
-		// ditch sent messages
-		c.messages.Init()
+		s.remember(messageArray)
+		s.sent = &messageArray
+		s.sentQueued = sentQueued
 
-		//log.Printf("ConnectionManager: pollCheck: sending to %s: %v\n", c.id, c.messages)
-		c.pollChannel <- &messageArray
+		//log.Printf("ConnectionManager: pollCheck: sending to %s: %v\n", c.id, s.messages)
+		s.pollChannel <- &messageArray
 		//log.Printf("ConnectionManager: pollCheck: sending to %s: complete\n", c.id)
 
-		// unmark connections as polling
-		c.polling = false
+		// unmark session as polling
+		s.polling = false
 	}
 }
 
 // Allocate and initialize a new connection
-func newConnection(id string) *Connection {
-	connection := &Connection{
-		pollChannel: nil, // will be set when the connection starts polling
-		polling:     false,
-		messages:    list.New(),
-		id:          id,
+func newConnection[T any](id string, queued *int, dead *deadLetterQueue[T]) *Connection[T] {
+	connection := &Connection[T]{
+		sessions: make(map[string]*session[T]), // added when polls arrive
+		backlog:  newMessageQueue[T](queued),
+		queued:   queued,
+		dead:     dead,
+		groups:   make(map[string]bool),
+		id:       id,
 	}
 
 	return connection
 }
 
+// Make a random hex ID, suitable for handing out to clients
+func randomId() string {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("randomId: %v", err))
+	}
+
+	return hex.EncodeToString(b)
+}
+
 // remove a connection from tracking
-func (cm *ConnectionManager) removeConnection(connection *Connection) {
-	// TODO
+//
+// Pollers waiting on the connection see their poll channels closed.
+func (cm *Manager[T]) removeConnection(connection *Connection[T]) {
+	for _, s := range connection.sessions {
+		if s.polling {
+			s.stopPollTimers()
+			close(s.pollChannel)
+			s.polling = false
+		}
+
+		s.messages.discard()
+	}
+
+	connection.backlog.discard()
+
+	for group := range connection.groups {
+		cm.unsubscribe(connection, group)
+	}
+
+	if connection.publicId != "" {
+		delete(cm.publicIds, connection.publicId)
+	}
+
+	delete(cm.connection, connection.id)
 }
 
 // Start or stop a connection manager service
-func (cm *ConnectionManager) SetActive(active bool) {
+func (cm *Manager[T]) SetActive(active bool) {
 	if active {
 		if !cm.active {
-			go runConnectionManager(cm)
+			go runManager(cm)
 			cm.active = true
 		}
 	} else {
 		if cm.active {
-			cm.SendMessage(&Message{
+			cm.SendMessage(&TypedMessage[T]{
 				Type: StopRequest,
 			})
 		}
 	}
 }
 
+// Set the maximum number of messages queued for each connection
+//
+// When a queue is full, the oldest message of the lowest priority is
+// dropped. Zero (the default) means no limit. Must be called before
+// SetActive(true).
+func (cm *Manager[T]) SetQueueLimit(limit int) {
+	cm.queueLimit = limit
+}
+
+// Set the Codec used wherever the manager encodes payloads: in its
+// Store, and to measure batches against PollRequest.MaxBytes
+//
+// The default is JSONCodec. Must be called before SetActive(true).
+func (cm *Manager[T]) SetCodec(codec Codec) {
+	cm.codec = codec
+}
+
 // Create a new ConnectionManager
 func New() *ConnectionManager {
-	cm := &ConnectionManager{
-		connection:     make(map[string]*Connection),
-		messageChannel: make(chan *Message, messageChannelSize),
+	return NewManager[*MessagePayload]()
+}
+
+// Create a new Manager for payloads of type T
+func NewManager[T any]() *Manager[T] {
+	cm := &Manager[T]{
+		connection:        make(map[string]*Connection[T]),
+		publicIds:         make(map[string]string),
+		messageChannel:    make(chan *TypedMessage[T], messageChannelSize),
+		scheduled:         make(map[string]*scheduledMessage[T]),
+		queries:           make(map[string]*pendingQuery[T]),
+		held:              make(map[string]*messageQueue[T]),
+		idempotent:        make(map[idempotencyKey]*idempotentResult[T]),
+		groups:            make(map[string]map[string]bool),
+		rateLimits:        make(map[MessageType]RateLimit),
+		buckets:           make(map[rateKey]*tokenBucket),
+		codec:             JSONCodec,
+		idempotencyWindow: defaultIdempotencyWindow,
 	}
 
 	return cm
@@ -179,8 +787,8 @@ func (cm *ConnectionManager) buildConnectionListResponse() []map[string]interfac
 // Sends a Message and receives a Message
 //
 // to be called from other threads
-func (cm *ConnectionManager) SendMessage(r *Message) *Message {
-	r.RChan = make(chan *Message)
+func (cm *Manager[T]) SendMessage(r *TypedMessage[T]) *TypedMessage[T] {
+	r.RChan = make(chan *TypedMessage[T])
 
 	//log.Printf("SendMessage: sending %s\n", *r)
 	cm.messageChannel <- r
@@ -195,46 +803,150 @@ func (cm *ConnectionManager) SendMessage(r *Message) *Message {
 }
 
 // Broadcasts a response to all connections
-func (cm *ConnectionManager) broadcast(r *Message) {
+func (cm *Manager[T]) broadcast(r *TypedEnvelope[T]) {
 	for _, c := range cm.connection {
-		// buffer to all connections
-		c.messages.PushBack(r)
+		// buffer to all connections, and send if polling
+		cm.deliverOrDrop(c, r)
+	}
+}
 
-		// send if polling
-		c.pollCheck()
+// Deliver a message that's going to many connections, dead-lettering
+// it for any that there's no room to queue it for
+func (cm *Manager[T]) deliverOrDrop(c *Connection[T], e *TypedEnvelope[T]) {
+	if cm.deliver(c, e) != nil {
+		cm.deadLetters.add(e, DeadLetterDropped, c.id, "")
+		cm.stats.Dropped++
+	}
+}
+
+// Broadcasts a message that started on this node to all connections
+// in the cluster, or to the members of its group if it has one
+func (cm *Manager[T]) publish(r *TypedEnvelope[T]) {
+	if r.group != "" {
+		cm.groupcast(r)
+	} else {
+		cm.broadcast(r)
+	}
+
+	if cm.cluster != nil {
+		cm.stats.RelayFailed += uint64(cm.cluster.relayBroadcast(r))
+	}
+
+	if cm.backplane != nil {
+		cm.stats.RelayFailed += uint64(cm.backplane.publish(r))
 	}
 }
 
 // Handle a ConnectRequest Message
-func (cm *ConnectionManager) handleConnectRequest(m *Message) {
-	var c *Connection
+//
+// If Message.Id is empty, the manager makes up the connection's ID, to
+// be kept private by the client as its credential, and a public ID that
+// other connections see it by. Both are returned in the response.
+func (cm *Manager[T]) handleConnectRequest(m *TypedMessage[T]) {
+	var c *Connection[T]
 	var present bool
 
+	id := m.Id
+	publicId := ""
+
+	if id == "" {
+		id, publicId = cm.newIdentity()
+	}
+
 	// make a new connection if we don't have it
-	if c, present = cm.connection[m.Id]; !present {
-		c = newConnection(m.Id)
+	if c, present = cm.connection[id]; !present {
+		if err := cm.checkConnections(); err != nil {
+			m.RChan <- &TypedMessage[T]{
+				Type: ConnectResponse,
+				Id:   m.Id,
+				Err:  err,
+			}
+
+			return
+		}
+
+		c = newConnection[T](id, &cm.queuedBytes, &cm.deadLetters)
+
+		//log.Printf("ConnectionManager: %s: new connection\n", id)
+
+		if publicId != "" {
+			c.publicId = publicId
+			cm.publicIds[publicId] = id
+		}
 
-		//log.Printf("ConnectionManager: %s: new connection\n", m.Id)
+		// pick up anything sent while it was away
+		cm.attachHeld(c)
+
+		// let the rest of the cluster know it's here now
+		if cm.cluster != nil {
+			cm.stats.RelayFailed += uint64(cm.cluster.claim(id, publicId))
+		}
+	}
+
+	// a TTL on the ConnectRequest sets the connection default
+	if m.TTL > 0 {
+		c.defaultTTL = m.TTL
 	}
 
 	// add to the list
-	cm.connection[m.Id] = c
+	cm.connection[id] = c
+
+	r := &TypedMessage[T]{
+		Type:     ConnectResponse,
+		Id:       id,
+		PublicId: c.publicId,
+		Err:      nil,
+	}
+
+	if cm.tokenSigner != nil {
+		r.Token = cm.tokenSigner.Issue(id, time.Now())
+	}
 
 	// send response
 	//log.Println("ConnectionManager: sending login response")
-	m.RChan <- &Message{
-		Type: ConnectResponse,
-		Id:   m.Id,
-		Err:  nil,
-	}
+	m.RChan <- r
 	//log.Println("ConnectionManager: sent login response")
 }
 
+// Handle a DisconnectRequest Message
+//
+// The connection is forgotten, along with its groups, and its queued
+// messages are dead-lettered. Pollers waiting on it see their poll
+// channels closed.
+func (cm *Manager[T]) handleDisconnectRequest(m *TypedMessage[T]) {
+	var err error
+
+	if c, ok := cm.connection[m.Id]; ok {
+		cm.deadLetters.addQueued(c.undelivered(), DeadLetterDisconnected, c.id, "")
+		cm.removeConnection(c)
+
+		// so that no node brings it back
+		if cm.cluster != nil {
+			cm.stats.RelayFailed += uint64(cm.cluster.release(c.id))
+		}
+	} else {
+		err = errors.New(fmt.Sprintf("DisconnectRequest: unknown user id: %s", m.Id))
+	}
+
+	m.RChan <- &TypedMessage[T]{
+		Type: DisconnectResponse,
+		Err:  err,
+	}
+}
+
 // Handle a StopRequest Message
-func (cm *ConnectionManager) handleStopRequest(m *Message) {
+//
+// Pending queries are forgotten, so their timers don't post to a
+// manager that's no longer listening.
+func (cm *Manager[T]) handleStopRequest(m *TypedMessage[T]) {
+	for correlationId, q := range cm.queries {
+		q.timer.Stop()
+		delete(cm.queries, correlationId)
+	}
+
 	//log.Println("ConnectionManager: sending stop response")
 
-	m.RChan <- &Message{
+	m.RChan <- &TypedMessage[T]{
 		Type: StopResponse,
 		Err:  nil,
 	}
@@ -245,13 +957,38 @@ func (cm *ConnectionManager) handleStopRequest(m *Message) {
 // Handle a PollRequest Message
 //
 // This will cause queued messages to be delivered, if any exist.
-func (cm *ConnectionManager) handlePollRequest(m *Message) {
+func (cm *Manager[T]) handlePollRequest(m *TypedMessage[T]) {
 	c, ok := cm.connection[m.Id]
 
+	// a connection held by another node moves here when its client
+	// polls here
+	if !ok && cm.cluster != nil && cm.cluster.remoteOwner(m.Id) != "" {
+		if err := cm.checkConnections(); err != nil {
+			m.RChan <- &TypedMessage[T]{
+				Type: PollResponse,
+				Err:  err,
+			}
+
+			return
+		}
+
+		c = newConnection[T](m.Id, &cm.queuedBytes, &cm.deadLetters)
+		cm.connection[m.Id] = c
+
+		// it keeps the public ID it was issued
+		if publicId := cm.cluster.publicIdOf(m.Id); publicId != "" {
+			c.publicId = publicId
+			cm.publicIds[publicId] = m.Id
+		}
+
+		cm.stats.RelayFailed += uint64(cm.cluster.claim(m.Id, c.publicId))
+		ok = true
+	}
+
 	if !ok {
 		//log.Printf("ConnectionManager: unknown user ID for PollMessage: %s\n", m.Id)
 
-		m.RChan <- &Message{
+		m.RChan <- &TypedMessage[T]{
 			Type: PollResponse,
 			Err:  errors.New(fmt.Sprintf("PollRequest: unknown user id: %s", m.Id)),
 		}
@@ -259,46 +996,109 @@ func (cm *ConnectionManager) handlePollRequest(m *Message) {
 		return
 	}
 
-	// If the connection is already polling, it means they've opened a
+	s := c.session(m.Session)
+
+	// If the session is already polling, it means they've opened a
 	// new polling connection. The old one needs to be shut down
 	// before we can continue
-	if c.polling {
-		close(c.pollChannel)
+	if s.polling {
+		s.stopPollTimers()
+		close(s.pollChannel)
 	}
 
-	// mark connection as polling
-	c.polling = true
-	c.pollChannel = make(chan *[]*Message)
+	// mark session as polling; the channel is buffered so that
+	// delivery never waits on a poller that has gone away
+	s.polling = true
+	s.pollChannel = make(chan *[]*TypedEnvelope[T], 1)
+	s.lastPoll = time.Now()
+
+	s.maxMessages = m.MaxMessages
+	s.maxBytes = m.MaxBytes
+	s.linger = m.Linger
+	s.lingered = false
+
+	if m.Timeout > 0 {
+		pollChannel := s.pollChannel
+		s.pollTimer = time.AfterFunc(m.Timeout, func() {
+			cm.messageChannel <- &TypedMessage[T]{
+				Type:     pollTimeout,
+				Id:       c.id,
+				Session:  s.id,
+				PollChan: pollChannel,
+			}
+		})
+	}
 
 	//log.Println("ConnectionManager: sending pollmessage response")
 
-	m.RChan <- &Message{
+	m.RChan <- &TypedMessage[T]{
 		Type:     PollResponse,
-		PollChan: c.pollChannel,
+		Session:  s.id,
+		PollChan: s.pollChannel,
 		Err:      nil,
 	}
 
 	//log.Println("ConnectionManager: sent pollmessage response")
 
+	// send again whatever the poller missed last time
+	if m.Seq > 0 {
+		if missed := s.sentAfter(m.Seq); len(missed) > 0 {
+			s.stopPollTimers()
+
+			messageArray := append([]*TypedEnvelope[T](nil), missed...)
+			s.pollChannel <- &messageArray
+			s.polling = false
+
+			return
+		}
+	}
+
 	// push if we already have something
-	c.pollCheck()
+	cm.pollCheck(c, s)
+}
+
+// Find the session a poll timer belongs to
+//
+// Returns nil if the poll has since completed or been replaced.
+func (cm *Manager[T]) timerSession(m *TypedMessage[T]) *session[T] {
+	c, ok := cm.connection[m.Id]
+	if !ok {
+		return nil
+	}
+
+	s, ok := c.sessions[m.Session]
+	if !ok || !s.polling || s.pollChannel != m.PollChan {
+		return nil
+	}
+
+	return s
 }
 
 // Handle a BroadcastRequest Message
 //
 // Message.Payload should be set to something useful
-//
-// Warning: changes m.Type to Broadcast
-func (cm *ConnectionManager) handleBroadcastRequest(m *Message) {
-	// change type from BroadcastRequest to Broadcast
-	m.Type = Broadcast
+func (cm *Manager[T]) handleBroadcastRequest(m *TypedMessage[T]) {
+	err := checkBroadcast(m)
+	if err == nil {
+		err = cm.checkPayload(m, cm.fanout(""))
+	}
 
-	// buffer messages and push to waiting connections
-	cm.broadcast(m)
+	if err != nil {
+		m.RChan <- &TypedMessage[T]{
+			Type: BroadcastResponse,
+			Err:  err,
+		}
+
+		return
+	}
+
+	// buffer messages and push to waiting connections, here and on
+	// other nodes
+	cm.publish(cm.seal(m, Broadcast))
 
 	//log.Println("ConnectionManager: sending broadcast response")
 
-	m.RChan <- &Message{
+	m.RChan <- &TypedMessage[T]{
 		Type: BroadcastResponse,
 		Err:  nil,
 	}
@@ -306,22 +1106,346 @@ func (cm *ConnectionManager) handleBroadcastRequest(m *Message) {
 	//log.Println("ConnectionManager: sent broadcast response")
 }
 
+// Check that a BroadcastRequest isn't meant for a group, which takes a
+// PublishRequest
+func checkBroadcast[T any](m *TypedMessage[T]) error {
+	if m.Group != "" {
+		return errors.New(fmt.Sprintf("BroadcastRequest: group set: %s (use a PublishRequest)", m.Group))
+	}
+
+	return nil
+}
+
+// Queue a message for a single connection
+func (cm *Manager[T]) unicast(e *TypedEnvelope[T]) error {
+	return cm.route(e, 0)
+}
+
+// Queue a message for a single connection, or pass it to the cluster
+// node holding the connection
+//
+// hops is how many times the message has already been passed between
+// nodes.
+func (cm *Manager[T]) route(e *TypedEnvelope[T], hops int) error {
+	c, ok := cm.findConnection(e.destId)
+
+	if !ok && cm.cluster != nil {
+		node := cm.cluster.remoteOwner(e.destId)
+		if node != "" && cm.cluster.forwardUnicast(e, node, hops) {
+			return nil
+		}
+	}
+
+	if !ok && cm.holdLimits.MaxPerId > 0 {
+		return cm.hold(e)
+	}
+
+	if !ok {
+		return errors.New(fmt.Sprintf("UnicastRequest: unknown destination id: %s", e.destId))
+	}
+
+	// buffer, and send if polling
+	return cm.deliver(c, e)
+}
+
+// Handle a UnicastRequest Message
+//
+// Message.DestId should be set to the recipient's ID
+func (cm *Manager[T]) handleUnicastRequest(m *TypedMessage[T]) {
+	if err := cm.checkPayload(m, cm.copiesFor(m.DestId)); err != nil {
+		m.RChan <- &TypedMessage[T]{
+			Type: UnicastResponse,
+			Err:  err,
+		}
+
+		return
+	}
+
+	err := cm.unicast(cm.seal(m, Unicast))
+
+	m.RChan <- &TypedMessage[T]{
+		Type: UnicastResponse,
+		Err:  err,
+	}
+}
+
+// Handle a lingerTimeout Message
+//
+// Sent by a poll's linger timer; delivers whatever has been batched.
+func (cm *Manager[T]) handleLingerTimeout(m *TypedMessage[T]) {
+	s := cm.timerSession(m)
+	if s == nil {
+		return
+	}
+
+	s.lingerTimer = nil
+	s.lingered = true
+
+	cm.pollCheck(cm.connection[m.Id], s)
+}
+
+// Handle a pollTimeout Message
+//
+// Sent by a poll's timer when its Timeout runs out; completes the poll
+// with whatever it has lingered for, or an empty batch.
+func (cm *Manager[T]) handlePollTimeout(m *TypedMessage[T]) {
+	s := cm.timerSession(m)
+	if s == nil {
+		return
+	}
+
+	s.pollTimer = nil
+	s.stopLinger()
+	s.lingered = true
+
+	cm.pollCheck(cm.connection[m.Id], s)
+
+	if s.polling {
+		s.pollChannel <- &[]*TypedEnvelope[T]{}
+		s.polling = false
+	}
+}
+
+// Handle an AbandonRequest Message
+//
+// Sent by a poller that has gone away, with the PollChan of its poll.
+// A poll still waiting is ended. If its batch was sent but never taken,
+// the batch is put back to be delivered to the session's next poll.
+func (cm *Manager[T]) handleAbandonRequest(m *TypedMessage[T]) {
+	var err error
+	var s *session[T]
+
+	c, ok := cm.connection[m.Id]
+	if ok {
+		s, ok = c.sessions[m.Session]
+	}
+
+	switch {
+	case !ok:
+		err = errors.New(fmt.Sprintf("AbandonRequest: unknown session: %s %q", m.Id, m.Session))
+
+	case s.polling && s.pollChannel == m.PollChan:
+		s.stopPollTimers()
+		s.polling = false
+
+	default:
+		select {
+		case batch, ok := <-m.PollChan:
+			// only the latest batch can go back without getting
+			// ahead of one sent after it
+			if ok && batch == s.sent {
+				s.requeue()
+			}
+		default:
+		}
+	}
+
+	m.RChan <- &TypedMessage[T]{
+		Type: AbandonResponse,
+		Err:  err,
+	}
+}
+
+// Put the last batch sent back at the front of the session's queue,
+// and forget it was delivered
+func (s *session[T]) requeue() {
+	for _, q := range s.sentQueued {
+		s.messages.insert(q)
+	}
+
+	// it's the tail of the history
+	n := len(s.history) - len(*s.sent)
+	s.history = s.history[:max(n, 0)]
+
+	s.sent = nil
+	s.sentQueued = nil
+}
+
+// Handle a clusterBroadcast Message
+//
+// Sent by a Cluster for a broadcast or group publish from another
+// node, or by a RedisBackplane for one published on Redis, with its
+// *TypedEnvelope in General.
+func (cm *Manager[T]) handleClusterBroadcast(m *TypedMessage[T]) {
+	e := m.General.(*TypedEnvelope[T])
+
+	if e.group != "" {
+		cm.groupcast(e)
+	} else {
+		cm.broadcast(e)
+	}
+
+	m.RChan <- &TypedMessage[T]{
+		Type: BroadcastResponse,
+		Err:  nil,
+	}
+}
+
+// Handle a clusterUnicast Message
+//
+// Sent by a Cluster for a message forwarded from another node, with the
+// *clusterForward it arrived in in General. This is usually a unicast,
+// but can be a broadcast or publish handed over with its connection, or
+// a SubscribeRequest carrying one of its subscriptions.
+func (cm *Manager[T]) handleClusterUnicast(m *TypedMessage[T]) {
+	f := m.General.(*clusterForward[T])
+	e := f.envelope
+
+	var err error
+
+	if e.typ == SubscribeRequest {
+		if c, ok := cm.connection[e.destId]; ok {
+			cm.subscribe(c, e.group)
+		}
+	} else if err = cm.route(e, f.hops); err != nil {
+		// there's nobody to tell, since it came from another node
+		cm.deadLetters.add(e, DeadLetterUndeliverable, e.destId, "")
+	}
+
+	m.RChan <- &TypedMessage[T]{
+		Type: UnicastResponse,
+		Err:  err,
+	}
+}
+
+// Handle a clusterClaim Message
+//
+// Sent by a Cluster when another node (in DestId) has claimed the
+// connection in Id. If we have it, its subscriptions and undelivered
+// messages are passed to the new node and it's removed here.
+func (cm *Manager[T]) handleClusterClaim(m *TypedMessage[T]) {
+	if c, ok := cm.connection[m.Id]; ok {
+		now := time.Now()
+
+		for group := range c.groups {
+			sm := &TypedEnvelope[T]{
+				typ:    SubscribeRequest,
+				destId: m.Id,
+				group:  group,
+			}
+
+			if !cm.cluster.forwardUnicast(sm, m.DestId, 0) {
+				cm.stats.RelayFailed++
+			}
+		}
+
+		for _, q := range c.undelivered() {
+			// keep only what's left of the time to live
+			var ttl time.Duration
+			if !q.expires.IsZero() {
+				ttl = q.expires.Sub(now)
+				if ttl <= 0 {
+					cm.deadLetters.addQueued([]*queuedMessage[T]{q}, DeadLetterExpired, m.Id, "")
+					continue
+				}
+			}
+
+			// copy, since broadcasts are shared between connections
+			fm := q.message.readdressed(m.Id, ttl)
+
+			if !cm.cluster.forwardUnicast(fm, m.DestId, 0) {
+				cm.stats.RelayFailed++
+				cm.deadLetters.addQueued([]*queuedMessage[T]{q}, DeadLetterUndeliverable, m.Id, "")
+			}
+		}
+
+		cm.removeConnection(c)
+	}
+
+	m.RChan <- &TypedMessage[T]{
+		Type: ConnectResponse,
+		Err:  nil,
+	}
+}
+
+// Handle a StatsRequest Message
+//
+// A copy of the counters is returned in the General field.
+func (cm *Manager[T]) handleStatsRequest(m *TypedMessage[T]) {
+	m.RChan <- &TypedMessage[T]{
+		Type:    StatsResponse,
+		General: cm.stats,
+		Err:     nil,
+	}
+}
+
 // Manages connections (runs as a goroutine)
-func runConnectionManager(cm *ConnectionManager) {
-	var message *Message
+func runManager[T any](cm *Manager[T]) {
+	var message *TypedMessage[T]
+
+	expireTicker := time.NewTicker(expireInterval)
+	defer expireTicker.Stop()
+
+	cm.scheduleTimer = time.NewTimer(0)
+	defer cm.scheduleTimer.Stop()
+	cm.resetScheduleTimer()
 
 	for {
 		//log.Printf("ConnectionManager: waiting for message %v %v", cm, cm.messageChannel)
 
-		message = <-cm.messageChannel
+		select {
+		case message = <-cm.messageChannel:
+		case <-expireTicker.C:
+			cm.expireAll()
+			continue
+		case <-cm.scheduleTimer.C:
+			cm.deliverScheduled(time.Now())
+			continue
+		}
 
 		//log.Printf("ConnectionManager: got message: %s\n", message)
 
+		// work on a copy, so the caller's request is left as it was
+		// sent (tokens are swapped for IDs, and payloads measured)
+		request := *message
+		message = &request
+
+		now := time.Now()
+
+		err := cm.checkToken(message, now)
+		if err == nil {
+			err = cm.authorize(message)
+		}
+
+		key, idempotent := idempotencyKeyOf(message)
+		if err == nil && idempotent && cm.answerRepeat(message, key, now) {
+			// a retry of something already done
+			continue
+		}
+
+		if err == nil {
+			err = cm.checkRate(message, now)
+		}
+
+		// each request type is followed by its response type
+		if err != nil {
+			message.RChan <- &TypedMessage[T]{
+				Type: message.Type + 1,
+				Err:  err,
+			}
+
+			continue
+		}
+
+		// handle a copy with its own response channel, so the
+		// response can be remembered under the key (the caller is
+		// still reading the original's)
+		var rchan chan *TypedMessage[T]
+		if idempotent {
+			rchan = message.RChan
+			diverted := *message
+			diverted.RChan = make(chan *TypedMessage[T], 1)
+			message = &diverted
+		}
+
 		switch message.Type {
 
 		case ConnectRequest:
 			cm.handleConnectRequest(message)
 
+		case DisconnectRequest:
+			cm.handleDisconnectRequest(message)
+
 		case StopRequest:
 			cm.handleStopRequest(message)
 			return // exit from the goroutine
@@ -332,10 +1456,77 @@ func runConnectionManager(cm *ConnectionManager) {
 		case BroadcastRequest:
 			cm.handleBroadcastRequest(message)
 
+		case StatsRequest:
+			cm.handleStatsRequest(message)
+
+		case lingerTimeout:
+			cm.handleLingerTimeout(message)
+
+		case pollTimeout:
+			cm.handlePollTimeout(message)
+
+		case clusterBroadcast, backplanePublish:
+			cm.handleClusterBroadcast(message)
+
+		case clusterUnicast:
+			cm.handleClusterUnicast(message)
+
+		case clusterClaim:
+			cm.handleClusterClaim(message)
+
+		case UnicastRequest:
+			cm.handleUnicastRequest(message)
+
+		case ScheduleRequest:
+			cm.handleScheduleRequest(message)
+
+		case CancelRequest:
+			cm.handleCancelRequest(message)
+
+		case ScheduledRequest:
+			cm.handleScheduledRequest(message)
+
+		case SubscribeRequest:
+			cm.handleSubscribeRequest(message)
+
+		case UnsubscribeRequest:
+			cm.handleUnsubscribeRequest(message)
+
+		case PublishRequest:
+			cm.handlePublishRequest(message)
+
+		case QueryRequest:
+			cm.handleQueryRequest(message)
+
+		case ReplyRequest:
+			cm.handleReplyRequest(message)
+
+		case queryTimeout:
+			cm.handleQueryTimeout(message)
+
+		case DeadLettersRequest:
+			cm.handleDeadLettersRequest(message)
+
+		case RequeueRequest:
+			cm.handleRequeueRequest(message)
+
+		case PurgeRequest:
+			cm.handlePurgeRequest(message)
+
+		case LookupRequest:
+			cm.handleLookupRequest(message)
+
+		case AbandonRequest:
+			cm.handleAbandonRequest(message)
+
 		default:
 			panic(fmt.Sprintf("Unknown message: \"%d\"", message.Type))
 		}
 
+		if idempotent {
+			cm.rememberResponse(message, key, rchan, now)
+		}
+
 		//log.Println("ConnectionManager: finished servicing message")
 	}
 }
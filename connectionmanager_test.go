@@ -0,0 +1,350 @@
+package connectionmanager
+
+import (
+	"testing"
+	"time"
+)
+
+// Start a ConnectionManager with the given connection IDs
+func startTestManager(t *testing.T, ids ...string) *ConnectionManager {
+	cm := New()
+	cm.SetActive(true)
+
+	for _, id := range ids {
+		resp := cm.SendMessage(&Message{
+			Type: ConnectRequest,
+			Id:   id,
+		})
+
+		if resp.Err != nil {
+			t.Fatalf("ConnectRequest %s: %v", id, resp.Err)
+		}
+	}
+
+	return cm
+}
+
+// Poll for a connection and wait for the batch
+func pollTest(t *testing.T, cm *ConnectionManager, m *Message) []*Envelope {
+	m.Type = PollRequest
+
+	resp := cm.SendMessage(m)
+	if resp.Err != nil {
+		t.Fatalf("PollRequest %s: %v", m.Id, resp.Err)
+	}
+
+	select {
+	case batch, ok := <-resp.PollChan:
+		if !ok {
+			t.Fatalf("poll channel for %s closed", m.Id)
+		}
+		return *batch
+
+	case <-time.After(2 * time.Second):
+		t.Fatalf("poll for %s timed out", m.Id)
+	}
+
+	return nil
+}
+
+// Send a broadcast with a single "text" payload
+func broadcastTest(t *testing.T, cm *ConnectionManager, m *Message, text string) {
+	m.Type = BroadcastRequest
+	m.Payload = &MessagePayload{"text": text}
+
+	resp := cm.SendMessage(m)
+	if resp.Err != nil {
+		t.Fatalf("BroadcastRequest %q: %v", text, resp.Err)
+	}
+}
+
+// Return the "text" payloads of a batch, in order
+func payloadText(batch []*Envelope) []string {
+	r := make([]string, len(batch))
+
+	for i, e := range batch {
+		r[i] = (*e.Payload())["text"].(string)
+	}
+
+	return r
+}
+
+func TestMessageTTL(t *testing.T) {
+	cm := startTestManager(t, "alpha")
+	defer cm.SetActive(false)
+
+	broadcastTest(t, cm, &Message{Id: "alpha", TTL: time.Millisecond}, "stale")
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "fresh")
+
+	time.Sleep(5 * time.Millisecond)
+
+	batch := payloadText(pollTest(t, cm, &Message{Id: "alpha"}))
+	if len(batch) != 1 || batch[0] != "fresh" {
+		t.Errorf("expected [fresh], got %v", batch)
+	}
+
+	stats := cm.SendMessage(&Message{Type: StatsRequest}).General.(Stats)
+	if stats.Expired != 1 {
+		t.Errorf("expected 1 expired message, got %d", stats.Expired)
+	}
+}
+
+func TestConnectionDefaultTTL(t *testing.T) {
+	cm := startTestManager(t)
+	defer cm.SetActive(false)
+
+	cm.SendMessage(&Message{Type: ConnectRequest, Id: "alpha", TTL: time.Millisecond})
+
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "stale")
+	time.Sleep(5 * time.Millisecond)
+	broadcastTest(t, cm, &Message{Id: "alpha", TTL: time.Hour}, "fresh")
+
+	batch := payloadText(pollTest(t, cm, &Message{Id: "alpha"}))
+	if len(batch) != 1 || batch[0] != "fresh" {
+		t.Errorf("expected [fresh], got %v", batch)
+	}
+}
+
+func TestPriorityOrder(t *testing.T) {
+	cm := startTestManager(t, "alpha")
+	defer cm.SetActive(false)
+
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "chat1")
+	broadcastTest(t, cm, &Message{Id: "alpha", Priority: 10}, "alert1")
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "chat2")
+	broadcastTest(t, cm, &Message{Id: "alpha", Priority: -1}, "typing")
+	broadcastTest(t, cm, &Message{Id: "alpha", Priority: 10}, "alert2")
+
+	batch := payloadText(pollTest(t, cm, &Message{Id: "alpha"}))
+	expected := []string{"alert1", "alert2", "chat1", "chat2", "typing"}
+
+	if len(batch) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, batch)
+	}
+	for i := range expected {
+		if batch[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, batch)
+		}
+	}
+}
+
+func TestQueueLimitShedsLowPriority(t *testing.T) {
+	cm := New()
+	cm.SetQueueLimit(3)
+	cm.SetActive(true)
+	defer cm.SetActive(false)
+
+	cm.SendMessage(&Message{Type: ConnectRequest, Id: "alpha"})
+
+	broadcastTest(t, cm, &Message{Id: "alpha", Priority: -1}, "typing1")
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "chat1")
+	broadcastTest(t, cm, &Message{Id: "alpha", Priority: -1}, "typing2")
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "chat2")
+	broadcastTest(t, cm, &Message{Id: "alpha", Priority: 10}, "alert")
+
+	batch := payloadText(pollTest(t, cm, &Message{Id: "alpha"}))
+	expected := []string{"alert", "chat1", "chat2"}
+
+	if len(batch) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, batch)
+	}
+	for i := range expected {
+		if batch[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, batch)
+		}
+	}
+
+	stats := cm.SendMessage(&Message{Type: StatsRequest}).General.(Stats)
+	if stats.Dropped != 2 {
+		t.Errorf("expected 2 dropped messages, got %d", stats.Dropped)
+	}
+}
+
+func TestPollBatchLimits(t *testing.T) {
+	cm := startTestManager(t, "alpha")
+	defer cm.SetActive(false)
+
+	for _, text := range []string{"one", "two", "three", "a much longer message"} {
+		broadcastTest(t, cm, &Message{Id: "alpha"}, text)
+	}
+
+	batch := payloadText(pollTest(t, cm, &Message{Id: "alpha", MaxMessages: 2}))
+	if len(batch) != 2 || batch[0] != "one" || batch[1] != "two" {
+		t.Errorf("expected [one two], got %v", batch)
+	}
+
+	// {"text":"three"} is 16 bytes, so the next message won't fit
+	batch = payloadText(pollTest(t, cm, &Message{Id: "alpha", MaxBytes: 20}))
+	if len(batch) != 1 || batch[0] != "three" {
+		t.Errorf("expected [three], got %v", batch)
+	}
+
+	// a single message over the limit is still delivered
+	batch = payloadText(pollTest(t, cm, &Message{Id: "alpha", MaxBytes: 20}))
+	if len(batch) != 1 || batch[0] != "a much longer message" {
+		t.Errorf("expected [a much longer message], got %v", batch)
+	}
+}
+
+func TestPollLinger(t *testing.T) {
+	cm := startTestManager(t, "alpha")
+	defer cm.SetActive(false)
+
+	resp := cm.SendMessage(&Message{
+		Type:   PollRequest,
+		Id:     "alpha",
+		Linger: 50 * time.Millisecond,
+	})
+
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "one")
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "two")
+
+	select {
+	case batch := <-resp.PollChan:
+		texts := payloadText(*batch)
+		if len(texts) != 2 {
+			t.Errorf("expected both messages in one batch, got %v", texts)
+		}
+
+	case <-time.After(2 * time.Second):
+		t.Fatalf("lingering poll never completed")
+	}
+}
+
+func TestPollTimeout(t *testing.T) {
+	cm := startTestManager(t, "alpha")
+	defer cm.SetActive(false)
+
+	batch := pollTest(t, cm, &Message{Id: "alpha", Timeout: 10 * time.Millisecond})
+	if len(batch) != 0 {
+		t.Errorf("expected empty batch, got %v", payloadText(batch))
+	}
+
+	// the connection is no longer polling, so this is queued for the
+	// next poll
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "one")
+
+	texts := payloadText(pollTest(t, cm, &Message{Id: "alpha", Timeout: time.Hour}))
+	if len(texts) != 1 || texts[0] != "one" {
+		t.Errorf("expected [one], got %v", texts)
+	}
+}
+
+func TestPollTimeoutWhileLingering(t *testing.T) {
+	cm := startTestManager(t, "alpha")
+	defer cm.SetActive(false)
+
+	resp := cm.SendMessage(&Message{
+		Type:    PollRequest,
+		Id:      "alpha",
+		Linger:  time.Hour,
+		Timeout: 20 * time.Millisecond,
+	})
+
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "one")
+
+	// the timeout cuts the linger short, but keeps what it collected
+	select {
+	case batch := <-resp.PollChan:
+		if texts := payloadText(*batch); len(texts) != 1 || texts[0] != "one" {
+			t.Errorf("expected [one], got %v", texts)
+		}
+
+	case <-time.After(2 * time.Second):
+		t.Fatalf("poll never timed out")
+	}
+}
+
+func TestMultipleSessions(t *testing.T) {
+	cm := startTestManager(t, "alpha")
+	defer cm.SetActive(false)
+
+	// queued before any session polls, so the first session gets it
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "early")
+
+	texts := payloadText(pollTest(t, cm, &Message{Id: "alpha", Session: "laptop"}))
+	if len(texts) != 1 || texts[0] != "early" {
+		t.Errorf("laptop: expected [early], got %v", texts)
+	}
+
+	phone := cm.SendMessage(&Message{Type: PollRequest, Id: "alpha", Session: "phone"})
+	laptop := cm.SendMessage(&Message{Type: PollRequest, Id: "alpha", Session: "laptop"})
+
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "one")
+
+	for name, resp := range map[string]*Message{"phone": phone, "laptop": laptop} {
+		select {
+		case batch, ok := <-resp.PollChan:
+			if !ok {
+				t.Fatalf("%s: poll channel closed", name)
+			}
+			if texts := payloadText(*batch); len(texts) != 1 || texts[0] != "one" {
+				t.Errorf("%s: expected [one], got %v", name, texts)
+			}
+
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: poll timed out", name)
+		}
+	}
+
+	// each session gets each message exactly once
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "two")
+
+	for _, name := range []string{"phone", "laptop"} {
+		texts := payloadText(pollTest(t, cm, &Message{Id: "alpha", Session: name}))
+		if len(texts) != 1 || texts[0] != "two" {
+			t.Errorf("%s: expected [two], got %v", name, texts)
+		}
+	}
+}
+
+// Application-defined payload for typed manager tests
+type chatLine struct {
+	User string
+	Text string
+}
+
+func TestTypedPayloads(t *testing.T) {
+	cm := NewManager[chatLine]()
+	cm.SetActive(true)
+	defer cm.SetActive(false)
+
+	cm.SendMessage(&TypedMessage[chatLine]{Type: ConnectRequest, Id: "alpha"})
+	cm.SendMessage(&TypedMessage[chatLine]{
+		Type:    BroadcastRequest,
+		Id:      "alpha",
+		Payload: chatLine{User: "alpha", Text: "hello"},
+	})
+
+	resp := cm.SendMessage(&TypedMessage[chatLine]{Type: PollRequest, Id: "alpha"})
+	batch := <-resp.PollChan
+
+	if len(*batch) != 1 || (*batch)[0].Payload().Text != "hello" {
+		t.Errorf("unexpected batch: %v", *batch)
+	}
+}
+
+func TestPollResend(t *testing.T) {
+	cm := startTestManager(t, "alpha")
+	defer cm.SetActive(false)
+
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "one")
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "two")
+
+	batch := pollTest(t, cm, &Message{Id: "alpha"})
+	if len(batch) != 2 || batch[0].Seq() != 1 || batch[1].Seq() != 2 {
+		t.Fatalf("expected messages 1 and 2, got %v", batch)
+	}
+
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "three")
+
+	// a poller that only got message 1 is sent 2 again first
+	if texts := payloadText(pollTest(t, cm, &Message{Id: "alpha", Seq: 1})); len(texts) != 1 || texts[0] != "two" {
+		t.Errorf("expected [two], got %v", texts)
+	}
+
+	batch = pollTest(t, cm, &Message{Id: "alpha", Seq: 2})
+	if len(batch) != 1 || batch[0].Seq() != 3 {
+		t.Errorf("expected message 3, got %v", batch)
+	}
+}
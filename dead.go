@@ -0,0 +1,234 @@
+// Dead-letter queue
+
+package connectionmanager
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Why a message was dead-lettered
+type DeadLetterReason int
+
+const (
+	// shed from a full queue
+	DeadLetterDropped DeadLetterReason = 1
+
+	// its TTL ran out before it was delivered
+	DeadLetterExpired DeadLetterReason = 2
+
+	// still queued when its connection was disconnected
+	DeadLetterDisconnected DeadLetterReason = 3
+
+	// couldn't be passed on to the node or connection it was meant for
+	DeadLetterUndeliverable DeadLetterReason = 4
+)
+
+func (r DeadLetterReason) String() string {
+	switch r {
+	case DeadLetterDropped:
+		return "dropped"
+	case DeadLetterExpired:
+		return "expired"
+	case DeadLetterDisconnected:
+		return "disconnected"
+	case DeadLetterUndeliverable:
+		return "undeliverable"
+	}
+
+	return fmt.Sprintf("DeadLetterReason(%d)", int(r))
+}
+
+// A message that was never delivered, returned in the General field of
+// a DeadLettersResponse
+type TypedDeadLetter[T any] struct {
+	// ID used to requeue or purge this entry
+	Id string
+
+	// Why it wasn't delivered
+	Reason DeadLetterReason
+
+	// The connection it was meant for, and the session if it was lost
+	// from just one session's queue
+	DestId  string
+	Session string
+
+	// When it was dead-lettered
+	At time.Time
+
+	// The message as it would have been delivered
+	Message TypedEnvelope[T]
+}
+
+// Dead letters with map payloads, as used by ConnectionManager
+type DeadLetter = TypedDeadLetter[*MessagePayload]
+
+// Messages that were never delivered, oldest first
+type deadLetterQueue[T any] struct {
+	// most letters kept (0 turns the queue off)
+	limit int
+
+	// *TypedDeadLetter[T], oldest first
+	letters list.List
+
+	// elements of letters by letter ID
+	byId map[string]*list.Element
+}
+
+// Keep up to limit messages that are lost before they're delivered, so
+// they can be inspected, requeued or purged with DeadLettersRequest,
+// RequeueRequest and PurgeRequest
+//
+// Messages are dead-lettered when they're shed from a full queue, when
+// their TTL runs out, when their connection is disconnected, or when
+// they can't be passed on to another cluster node or to a connection
+// there. A message queued for several sessions is dead-lettered once,
+// the first time it's lost. Past limit, the oldest letters are
+// forgotten. Zero (the default) keeps none. Must be called before
+// SetActive(true).
+func (cm *Manager[T]) SetDeadLetterLimit(limit int) {
+	cm.deadLetters.limit = limit
+}
+
+// Add a message to the dead-letter queue
+func (dq *deadLetterQueue[T]) add(e *TypedEnvelope[T], reason DeadLetterReason, destId string, session string) {
+	if dq.limit <= 0 {
+		return
+	}
+
+	if dq.byId == nil {
+		dq.byId = make(map[string]*list.Element)
+	}
+
+	d := &TypedDeadLetter[T]{
+		Id:      randomId(),
+		Reason:  reason,
+		DestId:  destId,
+		Session: session,
+		At:      time.Now(),
+		Message: *e,
+	}
+
+	dq.byId[d.Id] = dq.letters.PushBack(d)
+
+	for dq.letters.Len() > dq.limit {
+		dq.remove(dq.letters.Front())
+	}
+}
+
+// Dead-letter queued messages lost from a queue, unless they already
+// have been
+func (dq *deadLetterQueue[T]) addQueued(lost []*queuedMessage[T], reason DeadLetterReason, destId string, session string) {
+	for _, q := range lost {
+		if !q.deadLettered {
+			q.deadLettered = true
+			dq.add(q.delivered(), reason, destId, session)
+		}
+	}
+}
+
+// Take a letter out of the queue
+func (dq *deadLetterQueue[T]) remove(e *list.Element) {
+	delete(dq.byId, e.Value.(*TypedDeadLetter[T]).Id)
+	dq.letters.Remove(e)
+}
+
+// Handle a DeadLettersRequest Message
+//
+// A []TypedDeadLetter of the letters for Message.DestId (or all of
+// them, if it's not set), oldest first, is returned in the General
+// field.
+func (cm *Manager[T]) handleDeadLettersRequest(m *TypedMessage[T]) {
+	r := make([]TypedDeadLetter[T], 0)
+
+	for e := cm.deadLetters.letters.Front(); e != nil; e = e.Next() {
+		d := e.Value.(*TypedDeadLetter[T])
+		if m.DestId == "" || d.DestId == m.DestId {
+			r = append(r, *d)
+		}
+	}
+
+	m.RChan <- &TypedMessage[T]{
+		Type:    DeadLettersResponse,
+		General: r,
+		Err:     nil,
+	}
+}
+
+// Handle a RequeueRequest Message
+//
+// Message.Id should be the ID of a dead letter. Its message is queued
+// again for its connection (or held, if the connection has gone and
+// holding is on), and it leaves the dead-letter queue.
+func (cm *Manager[T]) handleRequeueRequest(m *TypedMessage[T]) {
+	var err error
+
+	e, ok := cm.deadLetters.byId[m.Id]
+
+	if ok {
+		d := e.Value.(*TypedDeadLetter[T])
+
+		// a fresh copy, so the letter's stays as it was
+		re := d.Message.readdressed(d.DestId, d.Message.ttl)
+
+		if c, ok := cm.connection[d.DestId]; ok {
+			err = cm.deliver(c, re)
+		} else if cm.holdLimits.MaxPerId > 0 {
+			err = cm.hold(re)
+		} else {
+			err = errors.New(fmt.Sprintf("RequeueRequest: unknown destination id: %s", d.DestId))
+		}
+
+		if err == nil {
+			cm.deadLetters.remove(e)
+		}
+	} else {
+		err = errors.New(fmt.Sprintf("RequeueRequest: unknown dead letter id: %s", m.Id))
+	}
+
+	m.RChan <- &TypedMessage[T]{
+		Type: RequeueResponse,
+		Id:   m.Id,
+		Err:  err,
+	}
+}
+
+// Handle a PurgeRequest Message
+//
+// Message.Id should be the ID of a dead letter to forget. If it's not
+// set, every letter for Message.DestId is forgotten, or every letter
+// if that's not set either. The number forgotten is returned in the
+// General field.
+func (cm *Manager[T]) handlePurgeRequest(m *TypedMessage[T]) {
+	var err error
+	count := 0
+
+	dq := &cm.deadLetters
+
+	if m.Id != "" {
+		if e, ok := dq.byId[m.Id]; ok {
+			dq.remove(e)
+			count++
+		} else {
+			err = errors.New(fmt.Sprintf("PurgeRequest: unknown dead letter id: %s", m.Id))
+		}
+	} else {
+		var next *list.Element
+		for e := dq.letters.Front(); e != nil; e = next {
+			next = e.Next()
+
+			if m.DestId == "" || e.Value.(*TypedDeadLetter[T]).DestId == m.DestId {
+				dq.remove(e)
+				count++
+			}
+		}
+	}
+
+	m.RChan <- &TypedMessage[T]{
+		Type:    PurgeResponse,
+		General: count,
+		Err:     err,
+	}
+}
@@ -0,0 +1,127 @@
+package connectionmanager
+
+import (
+	"testing"
+	"time"
+)
+
+// List the dead letters for an ID
+func deadLettersTest(t *testing.T, cm *ConnectionManager, id string) []DeadLetter {
+	resp := cm.SendMessage(&Message{Type: DeadLettersRequest, DestId: id})
+	if resp.Err != nil {
+		t.Fatalf("DeadLettersRequest: %v", resp.Err)
+	}
+
+	return resp.General.([]DeadLetter)
+}
+
+func TestDeadLetters(t *testing.T) {
+	cm := New()
+	cm.SetQueueLimit(1)
+	cm.SetDeadLetterLimit(10)
+	cm.SetActive(true)
+	defer cm.SetActive(false)
+
+	for _, id := range []string{"alpha", "beta", "gamma"} {
+		cm.SendMessage(&Message{Type: ConnectRequest, Id: id})
+	}
+
+	// shed from beta's full queue
+	unicastTest(t, cm, "alpha", "beta", "shed")
+	unicastTest(t, cm, "alpha", "beta", "kept")
+
+	// expired in gamma's, found when gamma polls
+	err := cm.SendMessage(&Message{
+		Type:    UnicastRequest,
+		Id:      "alpha",
+		DestId:  "gamma",
+		TTL:     time.Millisecond,
+		Payload: &MessagePayload{"text": "stale"},
+	}).Err
+	if err != nil {
+		t.Fatalf("unicast stale: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if batch := pollTest(t, cm, &Message{Id: "gamma", Timeout: 10 * time.Millisecond}); len(batch) != 0 {
+		t.Errorf("gamma: expected an empty batch, got %v", batch)
+	}
+
+	// left behind when beta leaves
+	cm.SendMessage(&Message{Type: DisconnectRequest, Id: "beta"})
+
+	letters := deadLettersTest(t, cm, "beta")
+	if len(letters) != 2 {
+		t.Fatalf("beta: expected 2 dead letters, got %v", letters)
+	}
+
+	for i, expect := range []struct {
+		reason DeadLetterReason
+		text   string
+	}{{DeadLetterDropped, "shed"}, {DeadLetterDisconnected, "kept"}} {
+		d := letters[i]
+		if d.Reason != expect.reason || (*d.Message.Payload())["text"] != expect.text || d.Message.Sender() != "alpha" {
+			t.Errorf("beta letter %d: expected %v %s from alpha, got %v %v", i, expect.reason, expect.text, d.Reason, d.Message)
+		}
+	}
+
+	gamma := deadLettersTest(t, cm, "gamma")
+	if len(gamma) != 1 || gamma[0].Reason != DeadLetterExpired {
+		t.Fatalf("gamma: expected 1 expired letter, got %v", gamma)
+	}
+
+	// requeue gamma's; it can't go to beta, who has gone
+	resp := cm.SendMessage(&Message{Type: RequeueRequest, Id: gamma[0].Id})
+	if resp.Err != nil {
+		t.Fatalf("RequeueRequest: %v", resp.Err)
+	}
+
+	if texts := payloadText(pollTest(t, cm, &Message{Id: "gamma"})); len(texts) != 1 || texts[0] != "stale" {
+		t.Errorf("gamma: expected [stale], got %v", texts)
+	}
+
+	resp = cm.SendMessage(&Message{Type: RequeueRequest, Id: letters[0].Id})
+	if resp.Err == nil {
+		t.Errorf("expected error requeuing for a departed id")
+	}
+
+	resp = cm.SendMessage(&Message{Type: PurgeRequest, DestId: "beta"})
+	if resp.Err != nil || resp.General.(int) != 2 {
+		t.Errorf("PurgeRequest: expected 2 purged, got %v %v", resp.General, resp.Err)
+	}
+
+	if all := deadLettersTest(t, cm, ""); len(all) != 0 {
+		t.Errorf("expected no dead letters left, got %v", all)
+	}
+}
+
+func TestDeadScheduledUnicast(t *testing.T) {
+	cm := New()
+	cm.SetDeadLetterLimit(10)
+	cm.SetActive(true)
+	defer cm.SetActive(false)
+
+	for _, id := range []string{"alpha", "beta"} {
+		cm.SendMessage(&Message{Type: ConnectRequest, Id: id})
+	}
+
+	scheduleTest(t, cm, time.Now().Add(10*time.Millisecond), &Message{
+		Type:    UnicastRequest,
+		Id:      "alpha",
+		DestId:  "beta",
+		Payload: &MessagePayload{"text": "too late"},
+	})
+
+	// beta leaves before it's due
+	cm.SendMessage(&Message{Type: DisconnectRequest, Id: "beta"})
+	time.Sleep(30 * time.Millisecond)
+
+	letters := deadLettersTest(t, cm, "beta")
+	if len(letters) != 1 || letters[0].Reason != DeadLetterUndeliverable {
+		t.Fatalf("expected 1 undeliverable letter, got %v", letters)
+	}
+
+	if texts := payloadText([]*Envelope{&letters[0].Message}); texts[0] != "too late" {
+		t.Errorf("expected too late, got %v", texts)
+	}
+}
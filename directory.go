@@ -0,0 +1,189 @@
+// Cluster-wide connection directory
+
+package connectionmanager
+
+// Most times a unicast is forwarded between nodes before it's dropped,
+// so stale directory entries can't bounce it around forever
+const maxForwardHops = 3
+
+// Which node holds a connection, as last claimed
+type directoryEntry struct {
+	// "" once the connection has been disconnected
+	node string
+
+	// public ID, if the manager issued the connection's ID
+	publicId string
+
+	// Lamport timestamp of the claim; the latest claim wins, with
+	// ties going to the greater node name
+	version uint64
+}
+
+// True if claim e should replace claim o
+func (e directoryEntry) newer(o directoryEntry) bool {
+	if e.version != o.version {
+		return e.version > o.version
+	}
+
+	return e.node > o.node
+}
+
+// Record a claim if it's newer than what we have
+//
+// Returns true if the directory changed.
+func (cl *Cluster[T]) record(id string, e directoryEntry) bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if e.version > cl.clock {
+		cl.clock = e.version
+	}
+
+	if old, ok := cl.directory[id]; ok && !e.newer(old) {
+		return false
+	}
+
+	cl.enter(id, e)
+
+	return true
+}
+
+// Put an entry in the directory, with the lock held
+func (cl *Cluster[T]) enter(id string, e directoryEntry) {
+	if old := cl.directory[id]; old.publicId != "" {
+		delete(cl.publicIds, old.publicId)
+	}
+
+	if e.publicId != "" {
+		cl.publicIds[e.publicId] = id
+	}
+
+	cl.directory[id] = e
+}
+
+// Claim a connection for this node and tell the other nodes, along
+// with its public ID if it has one
+//
+// Called from the manager's goroutine when a connection is created
+// here. Returns the number of nodes that couldn't be told.
+func (cl *Cluster[T]) claim(id string, publicId string) int {
+	cl.lock.Lock()
+	cl.clock++
+	e := directoryEntry{node: cl.transport.Local(), publicId: publicId, version: cl.clock}
+	cl.enter(id, e)
+	cl.lock.Unlock()
+
+	data, err := cl.encodeClaim(id, e)
+	if err != nil {
+		return len(cl.transport.Peers())
+	}
+
+	return cl.sendAll(data)
+}
+
+// Give up this node's claim on a connection that has been disconnected,
+// and tell the other nodes
+//
+// The release is kept, so that older claims can't bring the connection
+// back. Returns the number of nodes that couldn't be told.
+func (cl *Cluster[T]) release(id string) int {
+	cl.lock.Lock()
+	cl.clock++
+	e := directoryEntry{version: cl.clock}
+	cl.enter(id, e)
+	cl.lock.Unlock()
+
+	data, err := cl.encodeClaim(id, e)
+	if err != nil {
+		return len(cl.transport.Peers())
+	}
+
+	return cl.sendAll(data)
+}
+
+// Return the node that last claimed a connection, by its ID or public
+// ID, or "" if no node has or it has been released
+func (cl *Cluster[T]) owner(id string) string {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if e, ok := cl.directory[id]; ok {
+		return e.node
+	}
+
+	return cl.directory[cl.publicIds[id]].node
+}
+
+// Return the public ID a connection was issued, as last claimed, or ""
+func (cl *Cluster[T]) publicIdOf(id string) string {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	return cl.directory[id].publicId
+}
+
+// Return the node holding a connection if it's another node still in
+// the cluster, or ""
+func (cl *Cluster[T]) remoteOwner(id string) string {
+	node := cl.owner(id)
+	if node == "" || node == cl.transport.Local() {
+		return ""
+	}
+
+	for _, peer := range cl.transport.Peers() {
+		if peer == node {
+			return node
+		}
+	}
+
+	return ""
+}
+
+// Forget the claims of a node that has left
+func (cl *Cluster[T]) forgetNode(node string) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	for id, e := range cl.directory {
+		if e.node == node {
+			delete(cl.directory, id)
+			delete(cl.publicIds, e.publicId)
+		}
+	}
+}
+
+// Send this node's claims to a node that just joined
+func (cl *Cluster[T]) sendClaims(node string) {
+	local := cl.transport.Local()
+
+	cl.lock.Lock()
+	var frames [][]byte
+	for id, e := range cl.directory {
+		if e.node == local {
+			if data, err := cl.encodeClaim(id, e); err == nil {
+				frames = append(frames, data)
+			}
+		}
+	}
+	cl.lock.Unlock()
+
+	for _, data := range frames {
+		cl.transport.Send(node, data)
+	}
+}
+
+// Pass a unicast to the node that holds its recipient
+//
+// Returns false if the message couldn't be sent.
+func (cl *Cluster[T]) forwardUnicast(e *TypedEnvelope[T], node string, hops int) bool {
+	if hops >= maxForwardHops {
+		return false
+	}
+
+	data, err := cl.encode(clusterKindUnicast, e, hops+1, cl.peerCodec(node))
+	if err != nil {
+		return false
+	}
+
+	return cl.transport.Send(node, data) == nil
+}
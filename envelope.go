@@ -0,0 +1,131 @@
+// Read-only delivered messages
+
+package connectionmanager
+
+import (
+	"time"
+)
+
+// A message as connections receive it
+//
+// The manager makes an envelope from each request that sends something
+// (a BroadcastRequest, UnicastRequest, PublishRequest, QueryRequest or
+// ReplyRequest), and the request itself is left alone. One envelope is
+// shared by every connection it's queued for, so its fields can only be
+// read, through its methods.
+//
+// The payload isn't copied, though: an envelope holds the same value
+// the sender passed in Message.Payload. When that's a pointer or map,
+// as ConnectionManager's *MessagePayload is, the sender and every
+// recipient share what it refers to, and none of them should change it
+// once it's sent.
+type TypedEnvelope[T any] struct {
+	id            string
+	typ           MessageType
+	sender        string
+	destId        string
+	group         string
+	correlationId string
+	replyTo       string
+	timestamp     time.Time
+	payload       T
+	ttl           time.Duration
+	priority      int
+
+	// set on the copy delivered to each session
+	seq uint64
+
+	// encoded payload size, once the manager has measured it
+	size  int
+	sized bool
+}
+
+// Envelopes with map payloads, as used by ConnectionManager
+type Envelope = TypedEnvelope[*MessagePayload]
+
+// Unique ID of the message, the same in every copy delivered
+func (e *TypedEnvelope[T]) Id() string { return e.id }
+
+// Broadcast, Unicast, Publish, Query or Reply
+func (e *TypedEnvelope[T]) Type() MessageType { return e.typ }
+
+// ID of the connection that sent the message (its public ID, if the
+// manager issued it one), or "" if it came in over a backplane
+func (e *TypedEnvelope[T]) Sender() string { return e.sender }
+
+// ID of the recipient, for unicasts, queries and replies
+func (e *TypedEnvelope[T]) DestId() string { return e.destId }
+
+// Group a Publish was sent to
+func (e *TypedEnvelope[T]) Group() string { return e.group }
+
+// Matches a Reply to its Query
+func (e *TypedEnvelope[T]) CorrelationId() string { return e.correlationId }
+
+// Connection a Query's reply goes to
+func (e *TypedEnvelope[T]) ReplyTo() string { return e.replyTo }
+
+// When the manager accepted the message
+func (e *TypedEnvelope[T]) Timestamp() time.Time { return e.timestamp }
+
+// What the sender sent (shared, not copied; don't change it)
+func (e *TypedEnvelope[T]) Payload() T { return e.payload }
+
+// Time-to-live the sender asked for (0 means the recipient's default)
+func (e *TypedEnvelope[T]) TTL() time.Duration { return e.ttl }
+
+// Delivery priority
+func (e *TypedEnvelope[T]) Priority() int { return e.priority }
+
+// Sequence number, increasing in the order messages were queued for the
+// connection; give the last one received as the Seq of a PollRequest to
+// have anything sent after it delivered again
+func (e *TypedEnvelope[T]) Seq() uint64 { return e.seq }
+
+// Make the envelope for a request, as a message of type t
+//
+// The sender is shown by its public ID, if it has one, so the private
+// token never reaches other connections.
+func (cm *Manager[T]) seal(m *TypedMessage[T], t MessageType) *TypedEnvelope[T] {
+	return &TypedEnvelope[T]{
+		id:            randomId(),
+		typ:           t,
+		sender:        cm.publicId(m.Id),
+		destId:        m.DestId,
+		group:         m.Group,
+		correlationId: m.CorrelationId,
+		replyTo:       m.ReplyTo,
+		timestamp:     time.Now(),
+		payload:       m.Payload,
+		ttl:           m.TTL,
+		priority:      m.Priority,
+		size:          m.size,
+		sized:         m.sized,
+	}
+}
+
+// Return a copy of the envelope addressed to destId, with ttl left to
+// live
+func (e *TypedEnvelope[T]) readdressed(destId string, ttl time.Duration) *TypedEnvelope[T] {
+	r := *e
+	r.destId = destId
+	r.ttl = ttl
+	r.seq = 0
+
+	return &r
+}
+
+// Return the size of an envelope's payload as encoded by the manager's
+// codec
+func (cm *Manager[T]) envelopeSize(e *TypedEnvelope[T]) int {
+	if !e.sized {
+		data, err := cm.codec.Marshal(e.payload)
+		if err == nil {
+			e.size = len(data)
+		}
+
+		e.sized = true
+	}
+
+	return e.size
+}
@@ -0,0 +1,91 @@
+package connectionmanager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvelopes(t *testing.T) {
+	cm := startTestManager(t, "alpha", "beta")
+	defer cm.SetActive(false)
+
+	before := time.Now()
+
+	m := &Message{Type: BroadcastRequest, Id: "alpha", Payload: &MessagePayload{"text": "hi"}}
+	if resp := cm.SendMessage(m); resp.Err != nil {
+		t.Fatalf("BroadcastRequest: %v", resp.Err)
+	}
+
+	// the request is the caller's, and is left as it was
+	if m.Type != BroadcastRequest || m.Id != "alpha" {
+		t.Errorf("request changed: %v", m)
+	}
+
+	a := pollTest(t, cm, &Message{Id: "alpha"})
+	b := pollTest(t, cm, &Message{Id: "beta"})
+
+	if len(a) != 1 || len(b) != 1 {
+		t.Fatalf("expected one envelope each, got %v %v", a, b)
+	}
+
+	// each connection gets its own copy of the same message
+	if a[0] == b[0] || a[0].Id() == "" || a[0].Id() != b[0].Id() {
+		t.Errorf("expected separate copies with one ID, got %v %v", a[0], b[0])
+	}
+
+	e := b[0]
+	if e.Type() != Broadcast || e.Sender() != "alpha" || (*e.Payload())["text"] != "hi" {
+		t.Errorf("expected a broadcast of hi from alpha, got %v", e)
+	}
+
+	if e.Timestamp().Before(before) || e.Timestamp().After(time.Now()) {
+		t.Errorf("timestamp %v out of range", e.Timestamp())
+	}
+
+	// unicasts get IDs of their own
+	if resp := cm.SendMessage(&Message{Type: UnicastRequest, Id: "alpha", DestId: "beta", Payload: &MessagePayload{"text": "psst"}}); resp.Err != nil {
+		t.Fatalf("UnicastRequest: %v", resp.Err)
+	}
+
+	u := pollTest(t, cm, &Message{Id: "beta"})
+	if len(u) != 1 || u[0].Type() != Unicast || u[0].DestId() != "beta" || u[0].Id() == e.Id() {
+		t.Errorf("expected a new unicast to beta, got %v", u)
+	}
+}
+
+func TestRequestsLeftAlone(t *testing.T) {
+	cm := New()
+	cm.SetTokenSigner(NewTokenSigner("k1", []byte("secret")))
+	cm.SetQuotas(Quotas{MaxPayloadBytes: 100})
+	cm.SetActive(true)
+	defer cm.SetActive(false)
+
+	token := cm.SendMessage(&Message{Type: ConnectRequest, Id: "alpha"}).Token
+	beta := cm.SendMessage(&Message{Type: ConnectRequest, Id: "beta"}).Token
+
+	// the token isn't swapped for the ID, nor the payload measured, in
+	// the caller's request
+	m := &Message{Type: BroadcastRequest, Id: token, Payload: &MessagePayload{"text": "hi"}}
+	if resp := cm.SendMessage(m); resp.Err != nil {
+		t.Fatalf("BroadcastRequest: %v", resp.Err)
+	}
+
+	if m.Id != token || m.sized {
+		t.Errorf("request changed: %+v", m)
+	}
+	pollTest(t, cm, &Message{Id: beta})
+
+	// and a scheduled message is the manager's own copy
+	sm := &Message{Type: UnicastRequest, Id: "alpha", DestId: "beta", Payload: &MessagePayload{"text": "later"}}
+	scheduleTest(t, cm, time.Now().Add(10*time.Millisecond), sm)
+
+	if sm.sized {
+		t.Errorf("scheduled message changed: %+v", sm)
+	}
+	sm.DestId = "alpha"
+
+	texts := payloadText(pollTest(t, cm, &Message{Id: beta}))
+	if len(texts) != 1 || texts[0] != "later" {
+		t.Errorf("expected [later] for beta, got %v", texts)
+	}
+}
@@ -12,11 +12,15 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
-	//"time"
+	"time"
 )
 
 const webportDefault = "8080"
 
+// How long a long poll waits before returning an empty batch. This
+// must be shorter than the client's ajax timeout and any proxy timeouts.
+const pollTimeout = 60 * time.Second
+
 var webroot string
 var webport string
 
@@ -28,12 +32,6 @@ type CommandHandler struct {
 	connectionManager *connectionmanager.ConnectionManager
 }
 
-// Handler for long-poll requests (implements http.Handler)
-type LongPollHandler struct {
-	userManager       *UserManager
-	connectionManager *connectionmanager.ConnectionManager
-}
-
 // Helper function to make a status response
 func makeStatusResponse(status string, message string) *response {
 	return &response{
@@ -78,14 +76,18 @@ func (h *CommandHandler) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
 		// extract username
 		userName = rq.FormValue("username")
 
+		// no ID, so the connection manager makes up a private one
+		// for the client to poll and send with, and a public one
+		// for everyone else to see
 		resp = h.connectionManager.SendMessage(&connectionmanager.Message{
 			Type: connectionmanager.ConnectRequest,
-			Id:   id,
 		})
 
 		// if ok, record in our user list
 		if resp.Err == nil {
-			user, _ := h.userManager.AddUser(id, userName)
+			id = resp.Id
+
+			user, _ := h.userManager.AddUser(id, resp.PublicId, userName)
 			jresp, _ = json.Marshal(response{
 				"type":     "loginresponse",
 				"id":       id,
@@ -120,10 +122,13 @@ func (h *CommandHandler) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
 		user, err := h.userManager.GetUserByID(id)
 
 		if err == nil {
-			// send the broadcast request
+			// send the broadcast request; a client retrying after
+			// a network error sends the same key, so the message
+			// isn't broadcast twice
 			h.connectionManager.SendMessage(&connectionmanager.Message{
-				Type: connectionmanager.BroadcastRequest,
-				Id:   id,
+				Type:           connectionmanager.BroadcastRequest,
+				Id:             id,
+				IdempotencyKey: rq.FormValue("key"),
 				Payload: &connectionmanager.MessagePayload{
 					"type":     "message",
 					"username": user.name,
@@ -170,74 +175,12 @@ func (h *CommandHandler) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
 	}
 }
 
-// Service long-poll HTTP requests
-func (h *LongPollHandler) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
-	defer rq.Body.Close()
-
-	var jresp []byte
-
-	rw.Header().Set("Content-Type", "application/json")
-
-	// get ID
-	id := rq.FormValue("id")
-
-	//log.Printf("Chat: beginning long poll: %s\n", id)
-
-	// request messages from ConnectionManager
-	resp := h.connectionManager.SendMessage(&connectionmanager.Message{
-		Type: connectionmanager.PollRequest,
-		Id:   id,
-	})
-
-	// check for errors
-	if resp.Err != nil {
-		log.Printf("Chat: long poll request error: %s", resp.Err.Error())
-
-		jresp, _ := json.Marshal(*makeStatusResponse("error", resp.Err.Error()))
-		writeReponse(rw, &jresp)
-
-		return
-	}
-
-	// wait for messages
-	//log.Printf("Chat: long poll waiting on channel: %s\n", resp.RChan)
-
-	// response channel in resp
-	pollresp, ok := <-resp.PollChan
-
-	if ok {
-		messages := make([]*connectionmanager.MessagePayload, len(*pollresp))
-
-		for i, v := range *pollresp {
-			messages[i] = v.Payload
-		}
-
-		//log.Printf("Chat: long poll response received: %s\n", id)
-
-		// send messages in response
-		jresp, _ = json.Marshal(messages)
-
-		//log.Printf("Chat: completed long poll: %s\n", id)
-	} else {
-		//log.Printf("Chat: long poll channel closed\n")
-
-		// the remote side has probably closed at this point, but let's
-		// send a response anyway
-		jresp, _ = json.Marshal(*makeStatusResponse("error", "long poll canceled"))
-	}
-
-	//log.Printf(">>>>> %s", string(jresp))
-	writeReponse(rw, &jresp)
-}
-
 // Sets up the handlers and runs the HTTP server (run as a goroutine)
 func runWebServer(connectionManager *connectionmanager.ConnectionManager,
 	userManager *UserManager) {
 
-	longPollHandler := &LongPollHandler{
-		connectionManager: connectionManager,
-		userManager:       userManager,
-	}
+	longPollHandler := connectionmanager.NewLongPollHandler(connectionManager)
+	longPollHandler.Timeout = pollTimeout
 
 	commandHandler := &CommandHandler{
 		connectionManager: connectionManager,
@@ -245,9 +188,9 @@ func runWebServer(connectionManager *connectionmanager.ConnectionManager,
 	}
 
 	s := &http.Server{
-		Addr:    fmt.Sprintf(":%s", webport),
-		Handler: nil,
-		//ReadTimeout:    120 * time.Second,
+		Addr:        fmt.Sprintf(":%s", webport),
+		Handler:     nil,
+		ReadTimeout: 120 * time.Second,
 		//WriteTimeout:   2 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
@@ -20,23 +20,8 @@ func userTest(t *testing.T, um *UserManager, name string, id string) {
 		t.Errorf("u.id should be \"%s\", is \"%s\"", id, u.id)
 	}
 
-	pid := u.pubId
-
-	u2, err := um.GetUserByPubID(pid)
-
-	if err != nil {
-		t.Errorf("GetUserByPubId: %v", err)
-		return
-	}
-
-	if u.name != u2.name {
-		t.Errorf("u.name does not match u2.name: \"%s\" \"%s\"", u.name, u2.name)
-	}
-	if u.id != u2.id {
-		t.Errorf("u.id does not match u2.id: \"%s\" \"%s\"", u.id, u2.id)
-	}
-	if u.pubId != u2.pubId {
-		t.Errorf("u.pubId does not match u2.pubId: \"%s\" \"%s\"", u.pubId, u2.pubId)
+	if u.pubId != "pub-"+id {
+		t.Errorf("u.pubId should be \"pub-%s\", is \"%s\"", id, u.pubId)
 	}
 }
 
@@ -47,7 +32,7 @@ func TestUsermanager(t *testing.T) {
 
 	um.Start()
 
-	_, err = um.AddUser("alpha", "idA")
+	_, err = um.AddUser("alpha", "pub-alpha", "idA")
 
 	if err != nil {
 		t.Errorf("error adding user alpha: %v", err)
@@ -56,7 +41,7 @@ func TestUsermanager(t *testing.T) {
 
 	userTest(t, um, "idA", "alpha")
 
-	_, err = um.AddUser("bravo", "idB")
+	_, err = um.AddUser("bravo", "pub-bravo", "idB")
 
 	if err != nil {
 		t.Errorf("error adding user beta: %v", err)
@@ -67,7 +52,7 @@ func TestUsermanager(t *testing.T) {
 	userTest(t, um, "idB", "bravo")
 	userTest(t, um, "idA", "alpha")
 
-	_, err = um.AddUser("charlie", "idC")
+	_, err = um.AddUser("charlie", "pub-charlie", "idC")
 
 	if err != nil {
 		t.Errorf("error adding user charlie: %v", err)
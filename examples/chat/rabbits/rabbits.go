@@ -2,7 +2,6 @@
 package main
 
 import (
-	"code.google.com/p/go-uuid/uuid"
 	"launchpad.net/gnuflag"
 	"encoding/json"
 	"fmt"
@@ -62,7 +61,7 @@ func robotPoller(id string) {
 		outerObj := payload.([]interface{})
 
 		for _, v := range outerObj {
-			message := v.(map[string]interface{})
+			message := v.(map[string]interface{})["payload"].(map[string]interface{})
 
 			respType := message["type"].(string)
 
@@ -101,11 +100,9 @@ func robot() {
 	transport.DisableKeepAlives = true
 	client := &http.Client{Transport: transport}
 
-	id := uuid.New()
-
 	// login
 	resp, err := client.PostForm(msgurl,
-		url.Values{"command": {"login"}, "id": {id}})
+		url.Values{"command": {"login"}})
 
 	if err != nil {
 		log.Printf("http login error: %v", err)
@@ -142,6 +139,9 @@ func robot() {
 		}
 	}
 
+	// the server issues our private ID
+	id := outerObj["id"].(string)
+
 	// get additional user data
 	//publicId := outerObj["publicid"].(string)
 	//userName := outerObj["username"].(string)
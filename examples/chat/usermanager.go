@@ -4,17 +4,15 @@
 package main
 
 import (
-	"code.google.com/p/go-uuid/uuid"
 	"errors"
 	"fmt"
 )
 
 const (
-	commandStop           = 0
-	commandGetUserByID    = 1
-	commandGetUserByPubID = 2
-	commandAddUser        = 3
-	commandRemoveUser     = 4
+	commandStop        = 0
+	commandGetUserByID = 1
+	commandAddUser     = 3
+	commandRemoveUser  = 4
 )
 
 type userManagerCommand struct {
@@ -30,8 +28,8 @@ type userManagerCommandResponse struct {
 
 type User struct {
 	name  string
-	id    string
-	pubId string // public identifier
+	id    string // private identifier, issued by the connection manager
+	pubId string // public identifier, issued by the connection manager
 }
 
 // Manages user structs
@@ -39,9 +37,6 @@ type UserManager struct {
 	// Maps id to user
 	user map[string]*User
 
-	// Maps pubId to id
-	idMap map[string]string
-
 	// For making anonymous user names
 	nextGuestNumber int
 
@@ -60,7 +55,8 @@ func (um *UserManager) nextGuestName() string {
 func (um *UserManager) internalAddUser(command *userManagerCommand) *userManagerCommandResponse {
 	payload := command.payload.([]string)
 	id := payload[0]
-	name := payload[1]
+	pubId := payload[1]
+	name := payload[2]
 
 	u, ok := um.user[id]
 
@@ -77,10 +73,9 @@ func (um *UserManager) internalAddUser(command *userManagerCommand) *userManager
 	u = &User{
 		name:  name,
 		id:    id,
-		pubId: uuid.New(), // v4 UUID
+		pubId: pubId,
 	}
 
-	um.idMap[u.pubId] = id
 	um.user[u.id] = u
 
 	return &userManagerCommandResponse{payload: *u}
@@ -105,32 +100,6 @@ func (um *UserManager) internalGetUserById(command *userManagerCommand) *userMan
 	return resp
 }
 
-// Return a user by PubID
-func (um *UserManager) internalGetUserByPubId(command *userManagerCommand) *userManagerCommandResponse {
-	var resp *userManagerCommandResponse
-
-	pid := command.payload.(string)
-
-	id, ok := um.idMap[pid]
-	if !ok {
-		return &userManagerCommandResponse{
-			err: errors.New(fmt.Sprintf("unknown user pubID: %s", id)),
-		}
-	}
-
-	u, ok := um.user[id]
-
-	if ok {
-		resp = &userManagerCommandResponse{payload: *u}
-	} else {
-		resp = &userManagerCommandResponse{
-			err: errors.New(fmt.Sprintf("unknown user ID %s via pubID %s", id, pid)),
-		}
-	}
-
-	return resp
-}
-
 // Stop the server
 func (um *UserManager) internalStop(command *userManagerCommand) *userManagerCommandResponse {
 	return &userManagerCommandResponse{}
@@ -147,9 +116,6 @@ func (um *UserManager) requestHandler() {
 		case commandGetUserByID:
 			command.rchan <- um.internalGetUserById(command)
 
-		case commandGetUserByPubID:
-			command.rchan <- um.internalGetUserByPubId(command)
-
 		case commandAddUser:
 			command.rchan <- um.internalAddUser(command)
 		}
@@ -170,7 +136,6 @@ func getUserOrError(umr *userManagerCommandResponse) (*User, error) {
 func NewUserManager() *UserManager {
 	userManager := &UserManager{
 		user:            make(map[string]*User),
-		idMap:           make(map[string]string),
 		nextGuestNumber: 1,
 		requestChan:     make(chan *userManagerCommand),
 	}
@@ -210,28 +175,14 @@ func (um *UserManager) GetUserByID(id string) (*User, error) {
 	return getUserOrError(umr)
 }
 
-// Get a user by public ID
-func (um *UserManager) GetUserByPubID(id string) (*User, error) {
-	rchan := make(chan *userManagerCommandResponse)
-	um.requestChan <- &userManagerCommand{
-		rchan:       rchan,
-		commandType: commandGetUserByPubID,
-		payload:     id,
-	}
-
-	umr := <-rchan
-
-	return getUserOrError(umr)
-}
-
-// Add a new user
-func (um *UserManager) AddUser(id string, name string) (*User, error) {
+// Add a new user with the IDs the connection manager issued
+func (um *UserManager) AddUser(id string, pubId string, name string) (*User, error) {
 	rchan := make(chan *userManagerCommandResponse)
 
 	um.requestChan <- &userManagerCommand{
 		rchan:       rchan,
 		commandType: commandAddUser,
-		payload:     []string{id, name},
+		payload:     []string{id, pubId, name},
 	}
 
 	umr := <-rchan
@@ -8,6 +8,7 @@ var userInfo = {};
 var userList = []; // users on the chat
 var logger;
 var failMessagePosted = false;
+var lastSeq = 0; // of the last message polled
 
 // set up a logger
 if (typeof console == "undefined" || typeof console.log == "undefined") {
@@ -31,24 +32,6 @@ function defer(f)
 	setTimeout(f, 5);
 }
 
-/**
- * make random ID (UUID-ish), stolen from stackoverflow
- */
-function randomID()
-{
-	var S4 = function() {
-		return Math.floor(Math.random() * 0x10000).toString(16);
-	};
-
-	return (
-			S4() + S4() + "-" +
-			S4() + "-" +
-			S4() + "-" +
-			S4() + "-" +
-			S4() + S4() + S4()
-		);
-}
-
 /**
  * Add a message to the chat window
  */
@@ -120,7 +103,8 @@ function longPoll() {
 
 		// process
 		for (var i = 0, l = data.length; i < l; i++) {
-			handleMessage(data[i])
+			lastSeq = data[i].seq;
+			handleMessage(data[i].payload)
 		}
 
 		// again!
@@ -148,7 +132,7 @@ function longPoll() {
 
 	$.ajax({
 		"cache": false,
-		"data": { "id": userInfo.id },
+		"data": { "id": userInfo.id, "seq": lastSeq },
 		"timeout": 120*1000,
 		"url": "poll",
 		"type": "POST",
@@ -179,6 +163,8 @@ function sendCommand(data, success, error) {
  * Send text to the server
  */
 function sendText() {
+	var retries = 3;
+
 	function success(data, textStatus, jqXHR) {
 		if (data.type == "status" && data.status == "error") {
 			addChatMessage(null, "Error sending data to server: " + data.message);
@@ -187,19 +173,33 @@ function sendText() {
 	}
 
 	function error(jqXHR, textStatus, errorThrown) {
+		// the server may have got it anyway, but the key stops it
+		// being broadcast twice
+		if (retries-- > 0) {
+			setTimeout(send, 1000);
+			return;
+		}
+
 		addChatMessage(null, "Error sending data to server");
 	}
 
+	function send() {
+		sendCommand(data, success, error);
+	}
+
 	var text = $('#input-field').val();
 	text = $.trim(text);
 
 	if (text == '') { return; }
 
-	sendCommand({
-			"command": "broadcast",
-			"id": userInfo.id,
-			"message": text
-		}, success, error);
+	var data = {
+		"command": "broadcast",
+		"id": userInfo.id,
+		"message": text,
+		"key": userInfo.id + "-" + (new Date()).getTime() + "-" + Math.random()
+	};
+
+	send();
 }
 
 
@@ -223,7 +223,9 @@ function login(completeCallback) {
 			return
 		}
 
-		// get response
+		// get response; the server issues our private ID, which
+		// we poll and send with, and the public one others see
+		userInfo.id = data.id;
 		userInfo.pubId = data.publicid;
 		userInfo.username = data.username;
 
@@ -241,12 +243,9 @@ function login(completeCallback) {
 		logger("login error: " + textStatus);
 	}
 
-	userInfo.id = randomID();
-
 	// TODO: set up with a username ahead of time
 	sendCommand({
-			"command": "login",
-			"id": userInfo.id
+			"command": "login"
 		}, success, error);
 }
 
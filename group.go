@@ -0,0 +1,114 @@
+// Multicast groups
+
+package connectionmanager
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Add a connection to a group
+func (cm *Manager[T]) subscribe(c *Connection[T], group string) {
+	members, ok := cm.groups[group]
+	if !ok {
+		members = make(map[string]bool)
+		cm.groups[group] = members
+	}
+
+	members[c.id] = true
+	c.groups[group] = true
+}
+
+// Remove a connection from a group, forgetting the group once it's
+// empty
+func (cm *Manager[T]) unsubscribe(c *Connection[T], group string) {
+	delete(c.groups, group)
+
+	if members, ok := cm.groups[group]; ok {
+		delete(members, c.id)
+
+		if len(members) == 0 {
+			delete(cm.groups, group)
+		}
+	}
+}
+
+// Sends a message to the local members of its group
+func (cm *Manager[T]) groupcast(r *TypedEnvelope[T]) {
+	for id := range cm.groups[r.group] {
+		// buffer to all members, and send if polling
+		cm.deliverOrDrop(cm.connection[id], r)
+	}
+}
+
+// Handle a SubscribeRequest Message
+//
+// Message.Id should be set to the connection's ID, and Message.Group
+// to the group to join
+func (cm *Manager[T]) handleSubscribeRequest(m *TypedMessage[T]) {
+	var err error
+
+	if c, ok := cm.connection[m.Id]; !ok {
+		err = errors.New(fmt.Sprintf("SubscribeRequest: unknown user id: %s", m.Id))
+	} else if m.Group == "" {
+		err = errors.New("SubscribeRequest: no group")
+	} else if err = cm.checkGroups(c, m.Group); err == nil {
+		cm.subscribe(c, m.Group)
+	}
+
+	m.RChan <- &TypedMessage[T]{
+		Type: SubscribeResponse,
+		Err:  err,
+	}
+}
+
+// Handle an UnsubscribeRequest Message
+//
+// Leaving a group the connection isn't in is not an error.
+func (cm *Manager[T]) handleUnsubscribeRequest(m *TypedMessage[T]) {
+	var err error
+
+	if c, ok := cm.connection[m.Id]; !ok {
+		err = errors.New(fmt.Sprintf("UnsubscribeRequest: unknown user id: %s", m.Id))
+	} else {
+		cm.unsubscribe(c, m.Group)
+	}
+
+	m.RChan <- &TypedMessage[T]{
+		Type: UnsubscribeResponse,
+		Err:  err,
+	}
+}
+
+// Handle a PublishRequest Message
+//
+// Message.Group should be set to the group to publish to, and
+// Message.Payload to something useful. Publishing to a group with no
+// members here is not an error, since it may have members elsewhere in
+// the cluster.
+func (cm *Manager[T]) handlePublishRequest(m *TypedMessage[T]) {
+	if m.Group == "" {
+		m.RChan <- &TypedMessage[T]{
+			Type: PublishResponse,
+			Err:  errors.New("PublishRequest: no group"),
+		}
+
+		return
+	}
+
+	if err := cm.checkPayload(m, cm.fanout(m.Group)); err != nil {
+		m.RChan <- &TypedMessage[T]{
+			Type: PublishResponse,
+			Err:  err,
+		}
+
+		return
+	}
+
+	cm.publish(cm.seal(m, Publish))
+
+	m.RChan <- &TypedMessage[T]{
+		Type: PublishResponse,
+		Err:  nil,
+	}
+}
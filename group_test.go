@@ -0,0 +1,74 @@
+package connectionmanager
+
+import (
+	"testing"
+	"time"
+)
+
+// Send a group publish with a single "text" payload
+func publishTest(t *testing.T, cm *ConnectionManager, group string, text string) {
+	resp := cm.SendMessage(&Message{
+		Type:    PublishRequest,
+		Group:   group,
+		Payload: &MessagePayload{"text": text},
+	})
+
+	if resp.Err != nil {
+		t.Fatalf("PublishRequest %q: %v", text, resp.Err)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	cm := startTestManager(t, "alpha", "beta")
+	defer cm.SetActive(false)
+
+	for _, id := range []string{"alpha", "beta"} {
+		resp := cm.SendMessage(&Message{Type: SubscribeRequest, Id: id, Group: "rabbits"})
+		if resp.Err != nil {
+			t.Fatalf("SubscribeRequest %s: %v", id, resp.Err)
+		}
+	}
+
+	cm.SendMessage(&Message{Type: SubscribeRequest, Id: "alpha", Group: "hares"})
+
+	publishTest(t, cm, "rabbits", "hop")
+	publishTest(t, cm, "hares", "leap")
+
+	if texts := payloadText(pollTest(t, cm, &Message{Id: "alpha"})); len(texts) != 2 || texts[0] != "hop" || texts[1] != "leap" {
+		t.Errorf("alpha: expected [hop leap], got %v", texts)
+	}
+
+	if texts := payloadText(pollTest(t, cm, &Message{Id: "beta"})); len(texts) != 1 || texts[0] != "hop" {
+		t.Errorf("beta: expected [hop], got %v", texts)
+	}
+
+	cm.SendMessage(&Message{Type: UnsubscribeRequest, Id: "beta", Group: "rabbits"})
+
+	publishTest(t, cm, "rabbits", "skip")
+	broadcastTest(t, cm, &Message{Id: "alpha"}, "everyone")
+
+	if texts := payloadText(pollTest(t, cm, &Message{Id: "beta"})); len(texts) != 1 || texts[0] != "everyone" {
+		t.Errorf("beta: expected [everyone], got %v", texts)
+	}
+
+	resp := cm.SendMessage(&Message{Type: SubscribeRequest, Id: "nobody", Group: "rabbits"})
+	if resp.Err == nil {
+		t.Errorf("expected error subscribing unknown id")
+	}
+
+	resp = cm.SendMessage(&Message{Type: PublishRequest})
+	if resp.Err == nil {
+		t.Errorf("expected error publishing without a group")
+	}
+
+	// a broadcast can't be narrowed to a group, now or later
+	broadcast := &Message{Type: BroadcastRequest, Id: "alpha", Group: "rabbits", Payload: &MessagePayload{"text": "sneaky"}}
+
+	if resp = cm.SendMessage(broadcast); resp.Err == nil {
+		t.Errorf("expected error broadcasting to a group")
+	}
+
+	if resp = cm.SendMessage(&Message{Type: ScheduleRequest, At: time.Now(), General: broadcast}); resp.Err == nil {
+		t.Errorf("expected error scheduling a broadcast to a group")
+	}
+}
@@ -0,0 +1,133 @@
+// Store-and-forward for IDs that haven't connected
+
+package connectionmanager
+
+import (
+	"fmt"
+	"time"
+)
+
+// How long a message is held for an ID that hasn't connected, unless
+// told otherwise
+const defaultHoldTTL = time.Hour
+
+// Limits on messages held for IDs that haven't connected
+type HoldLimits struct {
+	// most messages held for each ID; when there are more, the oldest
+	// of the lowest priority is dropped (0 turns holding off)
+	MaxPerId int
+
+	// most messages held across all IDs; unicasts past it fail with a
+	// *HoldLimitError (0 means no limit)
+	MaxTotal int
+
+	// how long a message is held, unless its own TTL is shorter (0
+	// means 1 hour)
+	TTL time.Duration
+}
+
+// Returned for a UnicastRequest to an ID that hasn't connected when
+// MaxTotal messages are already held
+type HoldLimitError struct {
+	DestId string
+	Limit  int
+}
+
+func (e *HoldLimitError) Error() string {
+	return fmt.Sprintf("can't hold message for %s: limit of %d held messages reached", e.DestId, e.Limit)
+}
+
+// Hold unicasts to IDs that have no connection, rather than failing
+// them, until the ID connects
+//
+// Held messages are queued for the connection when a ConnectRequest
+// creates it. With a cluster, they're held on the node the unicast
+// reached when the directory didn't know the ID. Must be called before
+// SetActive(true).
+func (cm *Manager[T]) SetHoldLimits(limits HoldLimits) {
+	if limits.TTL <= 0 {
+		limits.TTL = defaultHoldTTL
+	}
+
+	cm.holdLimits = limits
+}
+
+// Hold a message for its recipient until it connects
+func (cm *Manager[T]) hold(e *TypedEnvelope[T]) error {
+	if limit := cm.holdLimits.MaxTotal; limit > 0 && cm.heldCount >= limit {
+		return &HoldLimitError{DestId: e.destId, Limit: limit}
+	}
+
+	ttl := cm.holdLimits.TTL
+	if e.ttl > 0 && e.ttl < ttl {
+		ttl = e.ttl
+	}
+
+	q := &queuedMessage[T]{message: e, size: -1, expires: time.Now().Add(ttl)}
+
+	if cm.quotas.MaxQueuedBytes > 0 {
+		q.size = cm.envelopeSize(e)
+		q.counted = q.size
+
+		if err := cm.checkQueued(q.size); err != nil {
+			return err
+		}
+	}
+
+	mq, ok := cm.held[e.destId]
+	if !ok {
+		mq = newMessageQueue[T](&cm.queuedBytes)
+		cm.held[e.destId] = mq
+	}
+
+	mq.insert(q)
+
+	lost := mq.shed(cm.holdLimits.MaxPerId)
+	cm.deadLetters.addQueued(lost, DeadLetterDropped, e.destId, "")
+	cm.stats.Dropped += uint64(len(lost))
+	cm.heldCount += 1 - len(lost)
+
+	return nil
+}
+
+// Queue the messages held for a new connection
+func (cm *Manager[T]) attachHeld(c *Connection[T]) {
+	mq, ok := cm.held[c.id]
+	if !ok {
+		return
+	}
+
+	delete(cm.held, c.id)
+	cm.heldCount -= mq.Len()
+
+	// number them as though they'd been queued for the connection
+	for e := mq.Front(); e != nil; e = e.Next() {
+		c.seq++
+		e.Value.(*queuedMessage[T]).seq = c.seq
+	}
+
+	c.backlog.discard()
+	c.backlog = mq
+}
+
+// Remove expired held messages
+//
+// Returns the number of messages expired.
+func (cm *Manager[T]) expireHeld(now time.Time) int {
+	count := 0
+
+	for id, mq := range cm.held {
+		lost := mq.expire(now)
+		cm.deadLetters.addQueued(lost, DeadLetterExpired, id, "")
+
+		count += len(lost)
+
+		if mq.Len() == 0 {
+			delete(cm.held, id)
+		}
+	}
+
+	cm.heldCount -= count
+
+	return count
+}
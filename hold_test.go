@@ -0,0 +1,64 @@
+package connectionmanager
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHeldUnicasts(t *testing.T) {
+	cm := New()
+	cm.SetHoldLimits(HoldLimits{MaxPerId: 2, MaxTotal: 3, TTL: time.Hour})
+	cm.SetActive(true)
+	defer cm.SetActive(false)
+
+	cm.SendMessage(&Message{Type: ConnectRequest, Id: "alpha"})
+
+	// beta's oldest is dropped to keep it to two
+	for _, text := range []string{"one", "two", "three"} {
+		unicastTest(t, cm, "alpha", "beta", text)
+	}
+
+	err := cm.SendMessage(&Message{
+		Type:    UnicastRequest,
+		Id:      "alpha",
+		DestId:  "gamma",
+		TTL:     10 * time.Millisecond,
+		Payload: &MessagePayload{"text": "short-lived"},
+	}).Err
+	if err != nil {
+		t.Fatalf("unicast to gamma: %v", err)
+	}
+
+	var hle *HoldLimitError
+	if err := cm.SendMessage(&Message{Type: UnicastRequest, Id: "alpha", DestId: "delta"}).Err; !errors.As(err, &hle) {
+		t.Errorf("expected HoldLimitError, got %v", err)
+	}
+
+	cm.SendMessage(&Message{Type: ConnectRequest, Id: "beta"})
+
+	if texts := payloadText(pollTest(t, cm, &Message{Id: "beta"})); len(texts) != 2 || texts[0] != "two" || texts[1] != "three" {
+		t.Errorf("beta: expected [two three], got %v", texts)
+	}
+
+	// held messages expire with their TTL
+	time.Sleep(20 * time.Millisecond)
+
+	cm.SendMessage(&Message{Type: ConnectRequest, Id: "gamma"})
+	unicastTest(t, cm, "alpha", "gamma", "fresh")
+
+	if texts := payloadText(pollTest(t, cm, &Message{Id: "gamma"})); len(texts) != 1 || texts[0] != "fresh" {
+		t.Errorf("gamma: expected [fresh], got %v", texts)
+	}
+
+	// and are held again once the recipient has gone
+	cm.SendMessage(&Message{Type: DisconnectRequest, Id: "beta"})
+
+	unicastTest(t, cm, "alpha", "beta", "welcome back")
+
+	cm.SendMessage(&Message{Type: ConnectRequest, Id: "beta"})
+
+	if texts := payloadText(pollTest(t, cm, &Message{Id: "beta"})); len(texts) != 1 || texts[0] != "welcome back" {
+		t.Errorf("beta: expected [welcome back], got %v", texts)
+	}
+}
@@ -0,0 +1,94 @@
+// Idempotent sends
+
+package connectionmanager
+
+import (
+	"time"
+)
+
+// How long results are remembered under their idempotency keys, unless
+// told otherwise
+const defaultIdempotencyWindow = 5 * time.Minute
+
+// Identifies a sender's idempotency key
+type idempotencyKey struct {
+	id  string
+	key string
+}
+
+// The result of a request, remembered under its idempotency key
+type idempotentResult[T any] struct {
+	// the response the request got
+	response *TypedMessage[T]
+
+	// when the request was handled
+	handled time.Time
+}
+
+// Set how long the results of requests with an IdempotencyKey are
+// remembered (0 means 5 minutes)
+//
+// A BroadcastRequest, UnicastRequest, PublishRequest or ScheduleRequest
+// repeating a key its sender used within the window gets the original
+// response, and nothing is queued again. Only successful requests are
+// remembered, so one that failed can be retried. Must be called before
+// SetActive(true).
+func (cm *Manager[T]) SetIdempotencyWindow(window time.Duration) {
+	if window <= 0 {
+		window = defaultIdempotencyWindow
+	}
+
+	cm.idempotencyWindow = window
+}
+
+// Return the key a request's result is remembered under, if it has one
+func idempotencyKeyOf[T any](m *TypedMessage[T]) (idempotencyKey, bool) {
+	if m.IdempotencyKey == "" {
+		return idempotencyKey{}, false
+	}
+
+	switch m.Type {
+	case BroadcastRequest, UnicastRequest, PublishRequest, ScheduleRequest:
+		return idempotencyKey{id: m.Id, key: m.IdempotencyKey}, true
+	}
+
+	return idempotencyKey{}, false
+}
+
+// Answer a request that repeats an earlier one with the earlier
+// response
+//
+// Returns true if the request was a repeat.
+func (cm *Manager[T]) answerRepeat(m *TypedMessage[T], key idempotencyKey, now time.Time) bool {
+	r, ok := cm.idempotent[key]
+	if !ok || now.Sub(r.handled) >= cm.idempotencyWindow {
+		return false
+	}
+
+	response := *r.response
+	m.RChan <- &response
+
+	return true
+}
+
+// Take a request's response from the channel it was diverted to,
+// remember it if the request succeeded, and pass it on to rchan
+func (cm *Manager[T]) rememberResponse(m *TypedMessage[T], key idempotencyKey, rchan chan *TypedMessage[T], now time.Time) {
+	response := <-m.RChan
+
+	if response.Err == nil {
+		saved := *response
+		cm.idempotent[key] = &idempotentResult[T]{response: &saved, handled: now}
+	}
+
+	rchan <- response
+}
+
+// Forget results older than the idempotency window
+func (cm *Manager[T]) pruneIdempotent(now time.Time) {
+	for key, r := range cm.idempotent {
+		if now.Sub(r.handled) >= cm.idempotencyWindow {
+			delete(cm.idempotent, key)
+		}
+	}
+}
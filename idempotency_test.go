@@ -0,0 +1,73 @@
+package connectionmanager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdempotentSends(t *testing.T) {
+	cm := New()
+	cm.SetIdempotencyWindow(100 * time.Millisecond)
+	cm.SetActive(true)
+	defer cm.SetActive(false)
+
+	for _, id := range []string{"alpha", "beta"} {
+		cm.SendMessage(&Message{Type: ConnectRequest, Id: id})
+	}
+
+	send := func(m *Message, key string, text string) *Message {
+		m.IdempotencyKey = key
+		m.Payload = &MessagePayload{"text": text}
+
+		resp := cm.SendMessage(m)
+		if resp.Err != nil {
+			t.Fatalf("%s: %v", text, resp.Err)
+		}
+
+		return resp
+	}
+
+	send(&Message{Type: BroadcastRequest, Id: "alpha"}, "k1", "once")
+	send(&Message{Type: BroadcastRequest, Id: "alpha"}, "k1", "once")
+
+	// keys belong to their sender
+	send(&Message{Type: BroadcastRequest, Id: "beta"}, "k1", "again")
+
+	send(&Message{Type: UnicastRequest, Id: "alpha", DestId: "beta"}, "k2", "direct")
+	send(&Message{Type: UnicastRequest, Id: "alpha", DestId: "beta"}, "k2", "direct")
+
+	if texts := payloadText(pollTest(t, cm, &Message{Id: "beta"})); len(texts) != 3 || texts[0] != "once" || texts[1] != "again" || texts[2] != "direct" {
+		t.Errorf("beta: expected [once again direct], got %v", texts)
+	}
+
+	// a repeated schedule gets the original ID
+	at := time.Now().Add(time.Hour)
+	first := send(&Message{Type: ScheduleRequest, At: at, General: &Message{Type: BroadcastRequest, Id: "alpha"}, Id: "alpha"}, "k3", "later")
+	second := send(&Message{Type: ScheduleRequest, At: at, General: &Message{Type: BroadcastRequest, Id: "alpha"}, Id: "alpha"}, "k3", "later")
+
+	if first.Id == "" || first.Id != second.Id {
+		t.Errorf("expected the same schedule ID, got %q and %q", first.Id, second.Id)
+	}
+
+	// failures aren't remembered, so they can be retried
+	resp := cm.SendMessage(&Message{Type: UnicastRequest, Id: "alpha", DestId: "gamma", IdempotencyKey: "k4"})
+	if resp.Err == nil {
+		t.Fatalf("expected error unicasting to unknown id")
+	}
+
+	cm.SendMessage(&Message{Type: ConnectRequest, Id: "gamma"})
+	send(&Message{Type: UnicastRequest, Id: "alpha", DestId: "gamma"}, "k4", "retried")
+
+	if texts := payloadText(pollTest(t, cm, &Message{Id: "gamma"})); len(texts) != 1 || texts[0] != "retried" {
+		t.Errorf("gamma: expected [retried], got %v", texts)
+	}
+
+	// and keys are forgotten after the window
+	time.Sleep(150 * time.Millisecond)
+
+	send(&Message{Type: BroadcastRequest, Id: "alpha"}, "k1", "much later")
+
+	if texts := payloadText(pollTest(t, cm, &Message{Id: "gamma"})); len(texts) != 1 || texts[0] != "much later" {
+		t.Errorf("gamma: expected [much later], got %v", texts)
+	}
+}
@@ -0,0 +1,94 @@
+// Manager-issued private tokens and public IDs
+
+package connectionmanager
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Make up a private token and a public ID for a new connection, neither
+// in use
+func (cm *Manager[T]) newIdentity() (string, string) {
+	for {
+		token, publicId := randomId(), randomId()
+
+		_, tokenUsed := cm.connection[token]
+		_, publicUsed := cm.publicIds[publicId]
+
+		if !tokenUsed && !publicUsed && token != publicId {
+			return token, publicId
+		}
+	}
+}
+
+// Find a connection by its ID, or by its public ID if it has one
+func (cm *Manager[T]) findConnection(id string) (*Connection[T], bool) {
+	if c, ok := cm.connection[id]; ok {
+		return c, true
+	}
+
+	if token, ok := cm.publicIds[id]; ok {
+		c, ok := cm.connection[token]
+		return c, ok
+	}
+
+	return nil, false
+}
+
+// Return the ID other connections know a connection by: its public ID,
+// if it has one here or was issued one on another node
+func (cm *Manager[T]) publicId(id string) string {
+	if c, ok := cm.connection[id]; ok && c.publicId != "" {
+		return c.publicId
+	}
+
+	if cm.cluster != nil {
+		if publicId := cm.cluster.publicIdOf(id); publicId != "" {
+			return publicId
+		}
+	}
+
+	return id
+}
+
+// Handle a LookupRequest Message
+//
+// Message.Id should be set to a connection's ID to find its public ID,
+// or Message.PublicId to a public ID to find the connection's ID. Both
+// are returned in the response. Since a connection's ID is its
+// credential, lookups by public ID are for the server's own use; don't
+// pass them on to clients.
+func (cm *Manager[T]) handleLookupRequest(m *TypedMessage[T]) {
+	var c *Connection[T]
+	var ok bool
+	var err error
+
+	if m.PublicId != "" {
+		var token string
+
+		if token, ok = cm.publicIds[m.PublicId]; ok {
+			c, ok = cm.connection[token]
+		}
+
+		if !ok {
+			err = errors.New(fmt.Sprintf("LookupRequest: unknown public id: %s", m.PublicId))
+		}
+	} else if c, ok = cm.connection[m.Id]; !ok {
+		err = errors.New(fmt.Sprintf("LookupRequest: unknown user id: %s", m.Id))
+	} else if c.publicId == "" {
+		err = errors.New(fmt.Sprintf("LookupRequest: no public id: %s", m.Id))
+	}
+
+	r := &TypedMessage[T]{
+		Type: LookupResponse,
+		Err:  err,
+	}
+
+	if err == nil {
+		r.Id = c.id
+		r.PublicId = c.publicId
+	}
+
+	m.RChan <- r
+}
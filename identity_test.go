@@ -0,0 +1,74 @@
+package connectionmanager
+
+import (
+	"testing"
+)
+
+func TestIssuedIds(t *testing.T) {
+	cm := startTestManager(t, "watcher")
+	defer cm.SetActive(false)
+
+	connect := func() (string, string) {
+		resp := cm.SendMessage(&Message{Type: ConnectRequest})
+		if resp.Err != nil {
+			t.Fatalf("ConnectRequest: %v", resp.Err)
+		}
+
+		if resp.Id == "" || resp.PublicId == "" || resp.Id == resp.PublicId {
+			t.Fatalf("expected distinct private and public IDs, got %q %q", resp.Id, resp.PublicId)
+		}
+
+		return resp.Id, resp.PublicId
+	}
+
+	alpha, alphaPublic := connect()
+	beta, betaPublic := connect()
+
+	// lookups go both ways
+	resp := cm.SendMessage(&Message{Type: LookupRequest, Id: alpha})
+	if resp.Err != nil || resp.PublicId != alphaPublic {
+		t.Errorf("lookup by ID: expected %s, got %q %v", alphaPublic, resp.PublicId, resp.Err)
+	}
+
+	resp = cm.SendMessage(&Message{Type: LookupRequest, PublicId: betaPublic})
+	if resp.Err != nil || resp.Id != beta {
+		t.Errorf("lookup by public ID: expected %s, got %q %v", beta, resp.Id, resp.Err)
+	}
+
+	resp = cm.SendMessage(&Message{Type: LookupRequest, Id: "watcher"})
+	if resp.Err == nil {
+		t.Errorf("expected error looking up a connection without a public ID")
+	}
+
+	// others only see the public ID
+	broadcastTest(t, cm, &Message{Id: alpha}, "hello")
+
+	batch := pollTest(t, cm, &Message{Id: "watcher"})
+	if len(batch) != 1 || batch[0].Sender() != alphaPublic {
+		t.Errorf("watcher: expected a broadcast from %s, got %v", alphaPublic, batch)
+	}
+
+	// and unicasts can be addressed by it
+	resp = cm.SendMessage(&Message{Type: UnicastRequest, Id: alpha, DestId: betaPublic, Payload: &MessagePayload{"text": "psst"}})
+	if resp.Err != nil {
+		t.Fatalf("UnicastRequest to public ID: %v", resp.Err)
+	}
+
+	batch = pollTest(t, cm, &Message{Id: beta})
+	if len(batch) != 2 || batch[1].Sender() != alphaPublic || (*batch[1].Payload())["text"] != "psst" {
+		t.Errorf("beta: expected psst from %s, got %v", alphaPublic, batch)
+	}
+
+	// a public ID is no good for acting as the connection
+	resp = cm.SendMessage(&Message{Type: PollRequest, Id: alphaPublic})
+	if resp.Err == nil {
+		t.Errorf("expected error polling with a public ID")
+	}
+
+	cm.SendMessage(&Message{Type: DisconnectRequest, Id: alpha})
+
+	resp = cm.SendMessage(&Message{Type: LookupRequest, PublicId: alphaPublic})
+	if resp.Err == nil {
+		t.Errorf("expected public ID to be forgotten after disconnect")
+	}
+}
@@ -0,0 +1,398 @@
+// Line-delimited JSON protocol, for clients outside the process
+
+package connectionmanager
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Longest request line a LineServer will accept
+const lineMaxLength = 16 << 20
+
+// A request on a LineServer connection
+//
+// Durations are in milliseconds.
+type lineRequest[T any] struct {
+	// echoed in the response, so clients can match them up
+	Seq int64 `json:"seq"`
+
+	// hello, connect, disconnect, poll, broadcast, unicast, subscribe,
+	// unsubscribe, publish, query or reply
+	Op string `json:"op"`
+
+	Id          string `json:"id"`
+	Dest        string `json:"dest"`
+	Group       string `json:"group"`
+	Session     string `json:"session"`
+	Payload     T      `json:"payload"`
+	TTL         int64  `json:"ttl"`
+	Priority    int    `json:"priority"`
+	MaxMessages int    `json:"max_messages"`
+	MaxBytes    int    `json:"max_bytes"`
+	Linger      int64  `json:"linger"`
+	Timeout     int64  `json:"timeout"`
+
+	// for polls, the "seq" of the last message received; whatever the
+	// session was sent after it is sent again
+	LastSeq uint64 `json:"last_seq"`
+
+	// for queries and replies
+	CorrelationId string `json:"correlation_id"`
+	ReplyTo       string `json:"reply_to"`
+
+	// credentials for the manager's Authorizer
+	Token string `json:"token"`
+
+	// makes a retried broadcast, unicast or publish harmless
+	IdempotencyKey string `json:"idempotency_key"`
+
+	// for hellos, the codecs the client can use, best first
+	Codecs []string `json:"codecs"`
+
+	// the payload, encoded with the codec agreed in a hello, in place
+	// of "payload"
+	Data []byte `json:"data"`
+}
+
+// A response on a LineServer connection
+type lineResponse[T any] struct {
+	Seq   int64  `json:"seq"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+
+	// for requests over a rate limit, milliseconds until a retry
+	// would be allowed
+	RetryAfter int64 `json:"retry_after,omitempty"`
+
+	// for queries, the correlation ID the reply will carry
+	CorrelationId string `json:"correlation_id,omitempty"`
+
+	// for connects without an ID, the private ID the manager issued
+	// and the public ID others will see
+	Id       string `json:"id,omitempty"`
+	PublicId string `json:"public_id,omitempty"`
+
+	// for connects, when the manager has a TokenSigner, the signed
+	// token to give as the "id" of polls
+	Token string `json:"token,omitempty"`
+
+	// for hellos, the codec agreed on
+	Codec string `json:"codec,omitempty"`
+
+	// for polls, the batch (left out if the poll timed out)
+	Messages []*lineMessage[T] `json:"messages,omitempty"`
+}
+
+// A message delivered to a poll
+type lineMessage[T any] struct {
+	// broadcast, unicast, publish, query or reply
+	Type string `json:"type"`
+
+	// the message's own ID, and when the manager accepted it
+	MessageId string    `json:"message_id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// sequence number within the polling session, to give as a poll's
+	// "last_seq"
+	Seq uint64 `json:"seq"`
+
+	// sender
+	Id string `json:"id,omitempty"`
+
+	// for publishes, the group
+	Group string `json:"group,omitempty"`
+
+	// for queries and replies
+	CorrelationId string `json:"correlation_id,omitempty"`
+	ReplyTo       string `json:"reply_to,omitempty"`
+
+	// the payload, as JSON or, if another codec was agreed in a hello,
+	// encoded with it in "data"
+	Payload T      `json:"payload"`
+	Data    []byte `json:"data,omitempty"`
+}
+
+// Serves a Manager to clients in other processes and languages, over
+// a protocol of one JSON object per line
+//
+// Each request line is answered with a response line carrying the same
+// "seq". Requests on a connection are handled concurrently (a poll
+// waits for messages while other requests go ahead), so responses can
+// come back out of order. See lineRequest for the request fields;
+// durations are in milliseconds.
+//
+//	> {"seq":1,"op":"connect","id":"alice"}
+//	< {"seq":1,"ok":true}
+//	> {"seq":2,"op":"poll","id":"alice","timeout":30000}
+//	> {"seq":3,"op":"broadcast","id":"alice","payload":{"text":"hi"}}
+//	< {"seq":3,"ok":true}
+//	< {"seq":2,"ok":true,"messages":[{"type":"broadcast","seq":1,"id":"alice","payload":{"text":"hi"}}]}
+//
+// A poll with a "last_seq" is first sent again whatever its session was
+// sent after that message, as far as the session remembers.
+//
+// A "hello" with a list of "codecs" picks the first one the server knows
+// for the rest of the socket's payloads, which are then sent both ways
+// in "data" (base64, as JSON encodes bytes) rather than "payload":
+//
+//	> {"seq":1,"op":"hello","codecs":["msgpack","binary"]}
+//	< {"seq":1,"ok":true,"codec":"binary"}
+//
+// Connections made here outlive the socket they were made on, as with
+// HTTP long polling, until they're disconnected. Polls still waiting
+// when the socket closes are abandoned, and any batch they hadn't sent
+// is kept for the session's next poll.
+type LineServer[T any] struct {
+	cm *Manager[T]
+}
+
+// Create a LineServer for a Manager
+func NewLineServer[T any](cm *Manager[T]) *LineServer[T] {
+	return &LineServer[T]{cm: cm}
+}
+
+// Accept and serve connections until the listener is closed
+func (s *LineServer[T]) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// Serve requests on a connection until it's closed, then close it
+func (s *LineServer[T]) ServeConn(conn io.ReadWriteCloser) {
+	defer conn.Close()
+
+	var writeLock sync.Mutex
+	enc := json.NewEncoder(conn)
+
+	respond := func(r *lineResponse[T]) {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+
+		enc.Encode(r)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, lineMaxLength)
+
+	codec := JSONCodec
+
+	// closed when the socket ends, to abandon waiting polls
+	done := make(chan struct{})
+
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var rq lineRequest[T]
+		if err := json.Unmarshal(scanner.Bytes(), &rq); err != nil {
+			respond(&lineResponse[T]{Error: fmt.Sprintf("bad request: %v", err)})
+			continue
+		}
+
+		// handled here, so requests after it use the new codec
+		if rq.Op == "hello" {
+			c, err := NegotiateCodec(rq.Codecs)
+			r := lineResult[T](&rq, err)
+
+			if err == nil {
+				codec = c
+				r.Codec = c.Name()
+			}
+
+			respond(r)
+			continue
+		}
+
+		go func(codec Codec) {
+			respond(lineHandle(s.cm, &rq, codec, done))
+		}(codec)
+	}
+
+	close(done)
+
+	// requests still being handled can't be answered now
+	writeLock.Lock()
+	enc = json.NewEncoder(io.Discard)
+	writeLock.Unlock()
+}
+
+// Carry out a request, whose payload, if it's in "data", is encoded with
+// codec
+//
+// A poll is abandoned if done is closed before its batch arrives.
+func lineHandle[T any](cm *Manager[T], rq *lineRequest[T], codec Codec, done <-chan struct{}) *lineResponse[T] {
+	payload := rq.Payload
+	if rq.Data != nil {
+		if err := codec.Unmarshal(rq.Data, &payload); err != nil {
+			return lineResult[T](rq, errors.New(fmt.Sprintf("bad data: %v", err)))
+		}
+	}
+
+	m := &TypedMessage[T]{
+		Id:       rq.Id,
+		DestId:   rq.Dest,
+		Group:    rq.Group,
+		Session:  rq.Session,
+		Payload:  payload,
+		TTL:      time.Duration(rq.TTL) * time.Millisecond,
+		Priority: rq.Priority,
+
+		IdempotencyKey: rq.IdempotencyKey,
+	}
+
+	if rq.Token != "" {
+		m.Credentials = rq.Token
+	}
+
+	switch rq.Op {
+	case "connect":
+		m.Type = ConnectRequest
+	case "disconnect":
+		m.Type = DisconnectRequest
+	case "broadcast":
+		m.Type = BroadcastRequest
+	case "unicast":
+		m.Type = UnicastRequest
+	case "subscribe":
+		m.Type = SubscribeRequest
+	case "unsubscribe":
+		m.Type = UnsubscribeRequest
+	case "publish":
+		m.Type = PublishRequest
+	case "query":
+		m.Type = QueryRequest
+		m.CorrelationId = rq.CorrelationId
+		m.ReplyTo = rq.ReplyTo
+		m.Timeout = time.Duration(rq.Timeout) * time.Millisecond
+	case "reply":
+		m.Type = ReplyRequest
+		m.CorrelationId = rq.CorrelationId
+	case "poll":
+		m.Type = PollRequest
+		m.MaxMessages = rq.MaxMessages
+		m.MaxBytes = rq.MaxBytes
+		m.Linger = time.Duration(rq.Linger) * time.Millisecond
+		m.Timeout = time.Duration(rq.Timeout) * time.Millisecond
+		m.Seq = rq.LastSeq
+	default:
+		return lineResult[T](rq, errors.New(fmt.Sprintf("unknown op: %q", rq.Op)))
+	}
+
+	resp := cm.SendMessage(m)
+	if resp.Err != nil || m.Type != PollRequest {
+		r := lineResult[T](rq, resp.Err)
+		r.CorrelationId = resp.CorrelationId
+
+		if resp.PublicId != "" {
+			r.Id = resp.Id
+			r.PublicId = resp.PublicId
+		}
+
+		r.Token = resp.Token
+
+		return r
+	}
+
+	var batch *[]*TypedEnvelope[T]
+	var ok bool
+
+	select {
+	case batch, ok = <-resp.PollChan:
+		if !ok {
+			return lineResult[T](rq, errors.New("poll canceled"))
+		}
+
+	case <-done:
+		cm.SendMessage(&TypedMessage[T]{
+			Type:        AbandonRequest,
+			Id:          m.Id,
+			Session:     resp.Session,
+			PollChan:    resp.PollChan,
+			Credentials: m.Credentials,
+		})
+
+		return lineResult[T](rq, errors.New("poll abandoned"))
+	}
+
+	r := lineResult[T](rq, nil)
+	r.Messages = make([]*lineMessage[T], len(*batch))
+
+	for i, bm := range *batch {
+		r.Messages[i] = newLineMessage(bm, codec)
+	}
+
+	return r
+}
+
+// Convert a delivered message for the protocol, encoding its payload
+// with codec unless that's JSONCodec
+func newLineMessage[T any](e *TypedEnvelope[T], codec Codec) *lineMessage[T] {
+	r := &lineMessage[T]{
+		Type:      lineMessageType(e.Type()),
+		MessageId: e.Id(),
+		Timestamp: e.Timestamp(),
+		Seq:       e.Seq(),
+		Id:        e.Sender(),
+		Group:     e.Group(),
+
+		CorrelationId: e.CorrelationId(),
+		ReplyTo:       e.ReplyTo(),
+	}
+
+	if codec.Name() == JSONCodec.Name() {
+		r.Payload = e.Payload()
+	} else {
+		r.Data, _ = codec.Marshal(e.Payload())
+	}
+
+	return r
+}
+
+// Build the response to a request
+func lineResult[T any](rq *lineRequest[T], err error) *lineResponse[T] {
+	r := &lineResponse[T]{Seq: rq.Seq, Ok: err == nil}
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	var rle *RateLimitError
+	if errors.As(err, &rle) {
+		r.RetryAfter = int64(math.Ceil(rle.RetryAfter.Seconds() * 1000))
+	}
+
+	return r
+}
+
+// Name a delivered message's type for the protocol
+func lineMessageType(t MessageType) string {
+	switch t {
+	case Broadcast:
+		return "broadcast"
+	case Unicast:
+		return "unicast"
+	case Publish:
+		return "publish"
+	case Query:
+		return "query"
+	case Reply:
+		return "reply"
+	}
+
+	return fmt.Sprintf("%d", t)
+}
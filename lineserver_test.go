@@ -0,0 +1,216 @@
+package connectionmanager
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A client of a LineServer
+type lineTestClient struct {
+	t       *testing.T
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+// Connect to a LineServer
+func dialLineServer(t *testing.T, network, addr string) *lineTestClient {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	return &lineTestClient{t: t, conn: conn, scanner: bufio.NewScanner(conn)}
+}
+
+// Send a request line
+func (c *lineTestClient) send(line string) {
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatalf("Write: %v", err)
+	}
+}
+
+// Read a response line
+func (c *lineTestClient) receive() *lineResponse[*MessagePayload] {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	if !c.scanner.Scan() {
+		c.t.Fatalf("no response: %v", c.scanner.Err())
+	}
+
+	var r lineResponse[*MessagePayload]
+	if err := json.Unmarshal(c.scanner.Bytes(), &r); err != nil {
+		c.t.Fatalf("bad response %q: %v", c.scanner.Text(), err)
+	}
+
+	return &r
+}
+
+// Send a request and expect it to succeed
+func (c *lineTestClient) call(line string) *lineResponse[*MessagePayload] {
+	c.send(line)
+
+	r := c.receive()
+	if !r.Ok {
+		c.t.Fatalf("%s: %s", line, r.Error)
+	}
+
+	return r
+}
+
+func TestLineServer(t *testing.T) {
+	cm := startTestManager(t)
+	defer cm.SetActive(false)
+
+	s := NewLineServer(cm)
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer tcp.Close()
+
+	unix, err := net.Listen("unix", filepath.Join(t.TempDir(), "cm.sock"))
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer unix.Close()
+
+	go s.Serve(tcp)
+	go s.Serve(unix)
+
+	a := dialLineServer(t, "tcp", tcp.Addr().String())
+	defer a.conn.Close()
+	b := dialLineServer(t, "unix", unix.Addr().String())
+	defer b.conn.Close()
+
+	a.call(`{"seq":1,"op":"connect","id":"alice"}`)
+	b.call(`{"seq":1,"op":"connect","id":"bob"}`)
+	a.call(`{"seq":2,"op":"subscribe","id":"alice","group":"rabbits"}`)
+
+	// the poll waits while the other requests go ahead
+	a.send(`{"seq":3,"op":"poll","id":"alice","linger":50}`)
+	b.call(`{"seq":2,"op":"unicast","id":"bob","dest":"alice","payload":{"text":"hi"}}`)
+	b.call(`{"seq":3,"op":"publish","group":"rabbits","payload":{"text":"hop"}}`)
+
+	r := a.receive()
+	if r.Seq != 3 || len(r.Messages) != 2 {
+		t.Fatalf("expected poll response with 2 messages, got %+v", r)
+	}
+
+	if m := r.Messages[0]; m.Type != "unicast" || m.Id != "bob" || (*m.Payload)["text"] != "hi" {
+		t.Errorf("unexpected message %+v", m)
+	}
+
+	if m := r.Messages[1]; m.Type != "publish" || m.Group != "rabbits" || (*m.Payload)["text"] != "hop" {
+		t.Errorf("unexpected message %+v", m)
+	}
+
+	// polls time out empty
+	r = b.call(`{"seq":4,"op":"poll","id":"bob","timeout":10}`)
+	if len(r.Messages) != 0 {
+		t.Errorf("expected empty poll, got %+v", r.Messages)
+	}
+
+	// a disconnect cancels the connection's poll
+	a.send(`{"seq":4,"op":"poll","id":"alice"}`)
+	b.call(`{"seq":5,"op":"disconnect","id":"alice"}`)
+
+	if r = a.receive(); r.Seq != 4 || r.Ok {
+		t.Errorf("expected canceled poll, got %+v", r)
+	}
+
+	b.send(`{"seq":6,"op":"unicast","id":"bob","dest":"alice","payload":{}}`)
+	if r = b.receive(); r.Seq != 6 || r.Ok {
+		t.Errorf("expected unicast to fail, got %+v", r)
+	}
+
+	b.send(`{"seq":7,"op":"explode"}`)
+	if r = b.receive(); r.Seq != 7 || r.Ok {
+		t.Errorf("expected unknown op to fail, got %+v", r)
+	}
+}
+
+func TestLineServerAbandon(t *testing.T) {
+	cm := startTestManager(t)
+	defer cm.SetActive(false)
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer tcp.Close()
+
+	go NewLineServer(cm).Serve(tcp)
+
+	a := dialLineServer(t, "tcp", tcp.Addr().String())
+	a.call(`{"seq":1,"op":"connect","id":"alice"}`)
+	a.send(`{"seq":2,"op":"poll","id":"alice"}`)
+
+	// the poll is abandoned when its socket closes, so the message
+	// waits for the next one
+	a.conn.Close()
+	time.Sleep(20 * time.Millisecond)
+	broadcastTest(t, cm, &Message{Id: "bob"}, "hi")
+
+	b := dialLineServer(t, "tcp", tcp.Addr().String())
+	defer b.conn.Close()
+
+	r := b.call(`{"seq":1,"op":"poll","id":"alice"}`)
+	if len(r.Messages) != 1 || (*r.Messages[0].Payload)["text"] != "hi" || r.Messages[0].Seq == 0 {
+		t.Fatalf("expected [hi] with a seq, got %+v", r.Messages)
+	}
+	seq := r.Messages[0].Seq
+
+	// a poll giving last_seq is sent again what came after it
+	broadcastTest(t, cm, &Message{Id: "bob"}, "again")
+	b.call(`{"seq":2,"op":"poll","id":"alice"}`)
+
+	r = b.call(fmt.Sprintf(`{"seq":3,"op":"poll","id":"alice","last_seq":%d}`, seq))
+	if len(r.Messages) != 1 || (*r.Messages[0].Payload)["text"] != "again" {
+		t.Errorf("expected [again] again, got %+v", r.Messages)
+	}
+}
+
+func TestLineServerCodec(t *testing.T) {
+	cm := startTestManager(t, "alice")
+	defer cm.SetActive(false)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+
+	go NewLineServer(cm).Serve(listener)
+
+	c := dialLineServer(t, "tcp", listener.Addr().String())
+	defer c.conn.Close()
+
+	if r := c.call(`{"seq":1,"op":"hello","codecs":["msgpack","binary"]}`); r.Codec != "binary" {
+		t.Fatalf("expected binary, got %+v", r)
+	}
+
+	data, _ := BinaryCodec.Marshal(&MessagePayload{"text": "hi"})
+	rq, _ := json.Marshal(map[string]interface{}{"seq": 2, "op": "broadcast", "id": "alice", "data": data})
+	c.call(string(rq))
+
+	r := c.call(`{"seq":3,"op":"poll","id":"alice"}`)
+	if len(r.Messages) != 1 {
+		t.Fatalf("expected one message, got %+v", r)
+	}
+
+	var payload *MessagePayload
+	if err := BinaryCodec.Unmarshal(r.Messages[0].Data, &payload); err != nil || (*payload)["text"] != "hi" {
+		t.Errorf("expected hi encoded in data, got %+v %v", r.Messages[0], err)
+	}
+
+	c.send(`{"seq":4,"op":"hello","codecs":["msgpack"]}`)
+	if r = c.receive(); r.Ok {
+		t.Errorf("expected hello with no known codec to fail, got %+v", r)
+	}
+}
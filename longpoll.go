@@ -0,0 +1,196 @@
+// Long-poll HTTP handler
+
+package connectionmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How long a LongPollHandler's polls wait before returning an empty
+// batch, unless told otherwise
+const longPollTimeout = 60 * time.Second
+
+// Serves long polls over HTTP (implements http.Handler)
+//
+// Each request polls a connection and waits for a batch, which is
+// returned as a JSON array of messages in the same form as a
+// LineServer poll's:
+//
+//	[{"type":"broadcast","seq":1,"id":"alice","payload":{"text":"hi"}}]
+//
+// A poll that times out returns an empty array. A poll with the "seq"
+// parameter set to the "seq" of the last message received is first
+// sent again whatever its session was sent after it, as far as the
+// session remembers. If the client goes away before its batch is sent,
+// the batch is kept for the session's next poll. Errors are returned
+// with an HTTP error status, as a JSON object:
+//
+//	{"type":"status","status":"error","message":"..."}
+//
+// Polls with bad tokens get 401 Unauthorized, polls the Authorizer
+// denies get 403 Forbidden, and polls over a rate limit get 429 Too
+// Many Requests, with a Retry-After header.
+//
+// The fields can be changed before the handler is used.
+type LongPollHandler[T any] struct {
+	cm *Manager[T]
+
+	// Returns the connection ID and session to poll for a request. If
+	// nil, they're taken from the "id" and "session" parameters. An
+	// error is returned to the client as 401 Unauthorized.
+	// Credentials for the manager's Authorizer come from the "token"
+	// parameter either way.
+	Identify func(rq *http.Request) (id string, session string, err error)
+
+	// How long a poll waits for messages (0 means 60 seconds). This
+	// must be shorter than the client's timeout and any proxy's.
+	Timeout time.Duration
+
+	// Batch limits for each poll, as in PollRequest
+	MaxMessages int
+	MaxBytes    int
+	Linger      time.Duration
+}
+
+// Create a LongPollHandler for a Manager
+func NewLongPollHandler[T any](cm *Manager[T]) *LongPollHandler[T] {
+	return &LongPollHandler[T]{cm: cm}
+}
+
+// Write a JSON response
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(statusResponse("error", err.Error()))
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(status)
+	rw.Write(data)
+}
+
+// Make a status response
+func statusResponse(status string, message string) map[string]string {
+	return map[string]string{
+		"type":    "status",
+		"status":  status,
+		"message": message,
+	}
+}
+
+// Take the connection ID and session from the request parameters
+func identifyByParams(rq *http.Request) (string, string, error) {
+	return rq.FormValue("id"), rq.FormValue("session"), nil
+}
+
+// The HTTP status for a refused PollRequest
+func pollErrorStatus(err error) int {
+	var te *TokenError
+	var ae *AuthorizationError
+	var rle *RateLimitError
+	var cle *ConnectionLimitError
+
+	switch {
+	case errors.As(err, &te):
+		return http.StatusUnauthorized
+	case errors.As(err, &ae):
+		return http.StatusForbidden
+	case errors.As(err, &rle):
+		return http.StatusTooManyRequests
+	case errors.As(err, &cle):
+		// a connection moving here from a full node; another node
+		// may have room
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusNotFound
+}
+
+// Take credentials for the manager's Authorizer from the "token"
+// request parameter
+func requestCredentials(rq *http.Request) interface{} {
+	if token := rq.FormValue("token"); token != "" {
+		return token
+	}
+
+	return nil
+}
+
+// Service a long poll
+func (h *LongPollHandler[T]) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
+	identify := h.Identify
+	if identify == nil {
+		identify = identifyByParams
+	}
+
+	id, session, err := identify(rq)
+	if err != nil {
+		writeJSON(rw, http.StatusUnauthorized, statusResponse("error", err.Error()))
+		return
+	}
+
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = longPollTimeout
+	}
+
+	// an unparseable seq just means starting afresh
+	after, _ := strconv.ParseUint(rq.FormValue("seq"), 10, 64)
+
+	credentials := requestCredentials(rq)
+
+	resp := h.cm.SendMessage(&TypedMessage[T]{
+		Type:        PollRequest,
+		Id:          id,
+		Session:     session,
+		Credentials: credentials,
+		Seq:         after,
+		Timeout:     timeout,
+		MaxMessages: h.MaxMessages,
+		MaxBytes:    h.MaxBytes,
+		Linger:      h.Linger,
+	})
+
+	if resp.Err != nil {
+		var rle *RateLimitError
+		if errors.As(resp.Err, &rle) {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rle.RetryAfter.Seconds()))))
+		}
+
+		writeJSON(rw, pollErrorStatus(resp.Err), statusResponse("error", resp.Err.Error()))
+		return
+	}
+
+	select {
+	case batch, ok := <-resp.PollChan:
+		if !ok {
+			// disconnected, or replaced by a newer poll
+			writeJSON(rw, http.StatusGone, statusResponse("error", "long poll canceled"))
+			return
+		}
+
+		messages := make([]*lineMessage[T], len(*batch))
+		for i, e := range *batch {
+			messages[i] = newLineMessage(e, JSONCodec)
+		}
+
+		writeJSON(rw, http.StatusOK, messages)
+
+	case <-rq.Context().Done():
+		// the client has gone; don't let the next batch go with it
+		h.cm.SendMessage(&TypedMessage[T]{
+			Type:        AbandonRequest,
+			Id:          id,
+			Session:     session,
+			PollChan:    resp.PollChan,
+			Credentials: credentials,
+		})
+	}
+}
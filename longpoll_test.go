@@ -0,0 +1,123 @@
+package connectionmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Make a long poll and decode the response
+func longPollTest(t *testing.T, server *httptest.Server, query string, v interface{}) int {
+	resp, err := http.Get(server.URL + "?" + query)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json, got %q", ct)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("bad response: %v", err)
+	}
+
+	return resp.StatusCode
+}
+
+func TestLongPollHandler(t *testing.T) {
+	cm := startTestManager(t, "alice")
+	defer cm.SetActive(false)
+
+	h := NewLongPollHandler(cm)
+	h.Timeout = 20 * time.Millisecond
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	broadcastTest(t, cm, &Message{Id: "alice"}, "hi")
+
+	var messages []*lineMessage[*MessagePayload]
+	if status := longPollTest(t, server, "id=alice", &messages); status != http.StatusOK {
+		t.Errorf("expected 200, got %d", status)
+	}
+	if len(messages) != 1 || (*messages[0].Payload)["text"] != "hi" || messages[0].Seq == 0 {
+		t.Fatalf("expected [hi] with a seq, got %v", messages)
+	}
+	seq := messages[0].Seq
+
+	// timeouts return an empty batch
+	messages = nil
+	longPollTest(t, server, "id=alice", &messages)
+	if messages == nil || len(messages) != 0 {
+		t.Errorf("expected empty batch, got %v", messages)
+	}
+
+	// a poll giving a seq is sent again what came after it
+	broadcastTest(t, cm, &Message{Id: "alice"}, "again")
+	longPollTest(t, server, "id=alice", &messages)
+	longPollTest(t, server, fmt.Sprintf("id=alice&seq=%d", seq), &messages)
+	if len(messages) != 1 || (*messages[0].Payload)["text"] != "again" {
+		t.Errorf("expected [again] again, got %v", messages)
+	}
+
+	var status map[string]string
+	if code := longPollTest(t, server, "id=nobody", &status); code != http.StatusNotFound || status["status"] != "error" {
+		t.Errorf("expected 404 error, got %d %v", code, status)
+	}
+
+	h.Identify = func(rq *http.Request) (string, string, error) {
+		return "", "", errors.New("who are you?")
+	}
+
+	if code := longPollTest(t, server, "id=alice", &status); code != http.StatusUnauthorized || status["message"] != "who are you?" {
+		t.Errorf("expected 401 error, got %d %v", code, status)
+	}
+}
+
+func TestPollErrorStatus(t *testing.T) {
+	statuses := map[error]int{
+		&TokenError{}:                    http.StatusUnauthorized,
+		&AuthorizationError{}:            http.StatusForbidden,
+		&RateLimitError{}:                http.StatusTooManyRequests,
+		&ConnectionLimitError{Limit: 10}: http.StatusServiceUnavailable,
+		errors.New("unknown user id"):    http.StatusNotFound,
+	}
+
+	for err, status := range statuses {
+		if s := pollErrorStatus(err); s != status {
+			t.Errorf("%T: expected %d, got %d", err, status, s)
+		}
+	}
+}
+
+func TestLongPollAbandon(t *testing.T) {
+	cm := startTestManager(t, "alice")
+	defer cm.SetActive(false)
+
+	server := httptest.NewServer(NewLongPollHandler(cm))
+	defer server.Close()
+
+	// a client that gives up on its poll...
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	rq, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?id=alice", nil)
+	if _, err := http.DefaultClient.Do(rq); err == nil {
+		t.Fatalf("expected the poll to be canceled")
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// ...doesn't take the next message with it
+	broadcastTest(t, cm, &Message{Id: "bob"}, "hi")
+
+	var messages []*lineMessage[*MessagePayload]
+	longPollTest(t, server, "id=alice", &messages)
+	if len(messages) != 1 || (*messages[0].Payload)["text"] != "hi" {
+		t.Errorf("expected [hi], got %v", messages)
+	}
+}
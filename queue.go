@@ -0,0 +1,188 @@
+// Priority-ordered message queues
+
+package connectionmanager
+
+import (
+	"container/list"
+	"time"
+)
+
+// A message waiting in a queue
+type queuedMessage[T any] struct {
+	message *TypedEnvelope[T]
+
+	// when this message expires (zero means never)
+	expires time.Time
+
+	// encoded payload size in bytes (-1 if not yet measured)
+	size int
+
+	// sequence number within the connection
+	seq uint64
+
+	// bytes counted against queue totals while this message is queued
+	counted int
+
+	// true once the message has been dead-lettered
+	deadLettered bool
+}
+
+// Queue of *queuedMessage, highest priority first
+type messageQueue[T any] struct {
+	list.List
+
+	// bytes counted for the messages in this queue
+	bytes int
+
+	// manager-wide count this queue adds to, if any
+	total *int
+}
+
+// Allocate a new empty queue, counting its bytes in total (if not nil)
+func newMessageQueue[T any](total *int) *messageQueue[T] {
+	return &messageQueue[T]{total: total}
+}
+
+// Change the queue's byte count
+func (mq *messageQueue[T]) count(n int) {
+	mq.bytes += n
+
+	if mq.total != nil {
+		*mq.total += n
+	}
+}
+
+// Remove a message from the queue
+func (mq *messageQueue[T]) Remove(e *list.Element) any {
+	mq.count(-e.Value.(*queuedMessage[T]).counted)
+
+	return mq.List.Remove(e)
+}
+
+// Empty the queue, for when it's being thrown away
+func (mq *messageQueue[T]) discard() {
+	mq.count(-mq.bytes)
+	mq.Init()
+}
+
+// Return a copy of a queued message for delivery, stamped with its
+// sequence number
+func (q *queuedMessage[T]) delivered() *TypedEnvelope[T] {
+	e := *q.message
+	e.seq = q.seq
+
+	return &e
+}
+
+// Return true if q is delivered after q2
+func (q *queuedMessage[T]) after(q2 *queuedMessage[T]) bool {
+	p, p2 := q.message.priority, q2.message.priority
+
+	return p < p2 || p == p2 && q.seq > q2.seq
+}
+
+// Return the size of a queued message's payload when encoded with codec
+//
+// The size is measured once, so every call must use the same codec.
+func (q *queuedMessage[T]) payloadSize(codec Codec) int {
+	if q.size < 0 {
+		data, err := codec.Marshal(q.message.payload)
+		if err != nil {
+			q.size = 0
+		} else {
+			q.size = len(data)
+		}
+	}
+
+	return q.size
+}
+
+// Add a message to the queue
+//
+// The message goes after all queued messages of higher priority, and
+// those of the same priority that were queued before it.
+func (mq *messageQueue[T]) insert(q *queuedMessage[T]) {
+	// find the last message we shouldn't pass
+	e := mq.Back()
+	for e != nil && e.Value.(*queuedMessage[T]).after(q) {
+		e = e.Prev()
+	}
+
+	if e == nil {
+		mq.PushFront(q)
+	} else {
+		mq.InsertAfter(q, e)
+	}
+
+	mq.count(q.counted)
+}
+
+// Shed messages until the queue is no longer than limit (0 means no
+// limit)
+//
+// The oldest message of the lowest priority goes first. Returns the
+// messages removed.
+func (mq *messageQueue[T]) shed(limit int) []*queuedMessage[T] {
+	var removed []*queuedMessage[T]
+
+	for limit > 0 && mq.Len() > limit {
+		// lowest priority is at the back; walk to the oldest one
+		e := mq.Back()
+		p := e.Value.(*queuedMessage[T]).message.priority
+		for prev := e.Prev(); prev != nil && prev.Value.(*queuedMessage[T]).message.priority == p; prev = prev.Prev() {
+			e = prev
+		}
+
+		mq.Remove(e)
+		removed = append(removed, e.Value.(*queuedMessage[T]))
+	}
+
+	return removed
+}
+
+// Remove expired messages
+//
+// Returns the messages removed.
+func (mq *messageQueue[T]) expire(now time.Time) []*queuedMessage[T] {
+	var removed []*queuedMessage[T]
+
+	var next *list.Element
+	for e := mq.Front(); e != nil; e = next {
+		next = e.Next()
+
+		q := e.Value.(*queuedMessage[T])
+		if !q.expires.IsZero() && !now.Before(q.expires) {
+			mq.Remove(e)
+			removed = append(removed, q)
+		}
+	}
+
+	return removed
+}
+
+// Return the queued messages that fit in a batch of at most
+// maxMessages messages and maxBytes payload bytes as encoded by codec
+// (0 means unlimited), highest priority first
+//
+// The first message is always included, even if it's over the byte
+// limit on its own, so that it can't block the queue.
+func (mq *messageQueue[T]) nextBatch(maxMessages, maxBytes int, codec Codec) []*list.Element {
+	var batch []*list.Element
+	bytes := 0
+
+	for e := mq.Front(); e != nil; e = e.Next() {
+		if maxMessages > 0 && len(batch) >= maxMessages {
+			break
+		}
+
+		size := e.Value.(*queuedMessage[T]).payloadSize(codec)
+		if maxBytes > 0 && len(batch) > 0 && bytes+size > maxBytes {
+			break
+		}
+
+		batch = append(batch, e)
+		bytes += size
+	}
+
+	return batch
+}
@@ -0,0 +1,163 @@
+// Hard limits on manager resources
+
+package connectionmanager
+
+import (
+	"fmt"
+)
+
+// Hard limits on what a Manager will hold (0 means no limit)
+type Quotas struct {
+	// most connections at once
+	MaxConnections int
+
+	// most groups each connection can be subscribed to
+	MaxGroups int
+
+	// largest payload a message can carry, in bytes as encoded by the
+	// manager's Codec
+	MaxPayloadBytes int
+
+	// most payload bytes queued across all connections, counting
+	// each copy queued for a session
+	MaxQueuedBytes int
+}
+
+// Returned for a ConnectRequest when the manager has MaxConnections
+// connections
+type ConnectionLimitError struct {
+	Limit int
+}
+
+func (e *ConnectionLimitError) Error() string {
+	return fmt.Sprintf("connection limit of %d reached", e.Limit)
+}
+
+// Returned for a SubscribeRequest when the connection is in MaxGroups
+// groups
+type GroupLimitError struct {
+	Id    string
+	Limit int
+}
+
+func (e *GroupLimitError) Error() string {
+	return fmt.Sprintf("%s is in the limit of %d groups", e.Id, e.Limit)
+}
+
+// Returned for a message whose payload is over MaxPayloadBytes
+type PayloadSizeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *PayloadSizeError) Error() string {
+	return fmt.Sprintf("payload of %d bytes is over the limit of %d", e.Size, e.Limit)
+}
+
+// Returned for a message that would take the bytes queued across the
+// manager over MaxQueuedBytes
+type QueuedBytesError struct {
+	Queued int
+	Size   int
+	Limit  int
+}
+
+func (e *QueuedBytesError) Error() string {
+	return fmt.Sprintf("%d bytes queued; another %d would be over the limit of %d", e.Queued, e.Size, e.Limit)
+}
+
+// Set hard limits on connections, groups, payload size and queued
+// bytes
+//
+// Requests that would break a limit are refused with a
+// *ConnectionLimitError, *GroupLimitError, *PayloadSizeError or
+// *QueuedBytesError. Must be called before SetActive(true).
+func (cm *Manager[T]) SetQuotas(quotas Quotas) {
+	cm.quotas = quotas
+}
+
+// Return the size of a message's payload as encoded by the manager's
+// Codec, measuring it the first time
+func (cm *Manager[T]) payloadSize(m *TypedMessage[T]) int {
+	if !m.sized {
+		data, err := cm.codec.Marshal(m.Payload)
+		if err == nil {
+			m.size = len(data)
+		}
+
+		m.sized = true
+	}
+
+	return m.size
+}
+
+// Check that there's room for another connection
+func (cm *Manager[T]) checkConnections() error {
+	if limit := cm.quotas.MaxConnections; limit > 0 && len(cm.connection) >= limit {
+		return &ConnectionLimitError{Limit: limit}
+	}
+
+	return nil
+}
+
+// Check that a connection can join another group
+func (cm *Manager[T]) checkGroups(c *Connection[T], group string) error {
+	if limit := cm.quotas.MaxGroups; limit > 0 && !c.groups[group] && len(c.groups) >= limit {
+		return &GroupLimitError{Id: c.id, Limit: limit}
+	}
+
+	return nil
+}
+
+// Check a message's payload size, and that there's room to queue
+// copies of it (0 if it isn't being queued yet)
+func (cm *Manager[T]) checkPayload(m *TypedMessage[T], copies int) error {
+	if limit := cm.quotas.MaxPayloadBytes; limit > 0 {
+		if size := cm.payloadSize(m); size > limit {
+			return &PayloadSizeError{Size: size, Limit: limit}
+		}
+	}
+
+	if copies > 0 && cm.quotas.MaxQueuedBytes > 0 {
+		return cm.checkQueued(cm.payloadSize(m) * copies)
+	}
+
+	return nil
+}
+
+// Return how many copies of a broadcast would be queued here, or of a
+// publish if group is set
+func (cm *Manager[T]) fanout(group string) int {
+	copies := 0
+
+	if group != "" {
+		for id := range cm.groups[group] {
+			copies += cm.connection[id].queues()
+		}
+	} else {
+		for _, c := range cm.connection {
+			copies += c.queues()
+		}
+	}
+
+	return copies
+}
+
+// Return how many copies of a message for destId would be queued here
+// (one if it would be held)
+func (cm *Manager[T]) copiesFor(destId string) int {
+	if c, ok := cm.findConnection(destId); ok {
+		return c.queues()
+	}
+
+	return 1
+}
+
+// Check that there's room to queue size more bytes
+func (cm *Manager[T]) checkQueued(size int) error {
+	if limit := cm.quotas.MaxQueuedBytes; limit > 0 && cm.queuedBytes+size > limit {
+		return &QueuedBytesError{Queued: cm.queuedBytes, Size: size, Limit: limit}
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package connectionmanager
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotas(t *testing.T) {
+	cm := New()
+	cm.SetQuotas(Quotas{
+		MaxConnections:  2,
+		MaxGroups:       1,
+		MaxPayloadBytes: 100,
+		MaxQueuedBytes:  128,
+	})
+	cm.SetActive(true)
+	defer cm.SetActive(false)
+
+	for _, id := range []string{"alpha", "beta"} {
+		if err := cm.SendMessage(&Message{Type: ConnectRequest, Id: id}).Err; err != nil {
+			t.Fatalf("ConnectRequest %s: %v", id, err)
+		}
+	}
+
+	var cle *ConnectionLimitError
+	if err := cm.SendMessage(&Message{Type: ConnectRequest, Id: "gamma"}).Err; !errors.As(err, &cle) {
+		t.Errorf("expected ConnectionLimitError, got %v", err)
+	}
+
+	// reconnecting isn't a new connection
+	if err := cm.SendMessage(&Message{Type: ConnectRequest, Id: "alpha"}).Err; err != nil {
+		t.Errorf("reconnect: %v", err)
+	}
+
+	cm.SendMessage(&Message{Type: SubscribeRequest, Id: "alpha", Group: "rabbits"})
+
+	var gle *GroupLimitError
+	if err := cm.SendMessage(&Message{Type: SubscribeRequest, Id: "alpha", Group: "hares"}).Err; !errors.As(err, &gle) {
+		t.Errorf("expected GroupLimitError, got %v", err)
+	}
+
+	var pse *PayloadSizeError
+	big := &MessagePayload{"text": strings.Repeat("x", 100)}
+	if err := cm.SendMessage(&Message{Type: BroadcastRequest, Payload: big}).Err; !errors.As(err, &pse) {
+		t.Errorf("expected PayloadSizeError, got %v", err)
+	}
+
+	// each of these queues 16 bytes for each of two connections
+	small := func() error {
+		return cm.SendMessage(&Message{Type: BroadcastRequest, Payload: &MessagePayload{"text": "abcde"}}).Err
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := small(); err != nil {
+			t.Fatalf("broadcast %d: %v", i, err)
+		}
+	}
+
+	var qbe *QueuedBytesError
+	if err := small(); !errors.As(err, &qbe) || qbe.Queued != 128 {
+		t.Errorf("expected QueuedBytesError at 128 bytes, got %v", err)
+	}
+
+	// delivering makes room again
+	pollTest(t, cm, &Message{Id: "alpha"})
+
+	if err := small(); err != nil {
+		t.Errorf("after poll: %v", err)
+	}
+
+	// as does disconnecting
+	cm.SendMessage(&Message{Type: DisconnectRequest, Id: "beta"})
+
+	resp := cm.SendMessage(&Message{Type: ConnectRequest, Id: "gamma"})
+	if resp.Err != nil {
+		t.Errorf("after disconnect: %v", resp.Err)
+	}
+
+	// alpha still has 16 bytes queued
+	for i := 0; i < 3; i++ {
+		if err := small(); err != nil {
+			t.Fatalf("broadcast %d after disconnect: %v", i, err)
+		}
+	}
+
+	if err := small(); !errors.As(err, &qbe) || qbe.Queued != 112 {
+		t.Errorf("expected QueuedBytesError at 112 bytes, got %v", err)
+	}
+}
+
+func TestQueuedBytesFanout(t *testing.T) {
+	cm := New()
+	cm.SetQuotas(Quotas{MaxQueuedBytes: 100})
+	cm.SetDeadLetterLimit(10)
+	cm.SetActive(true)
+	defer cm.SetActive(false)
+
+	ids := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, id := range ids {
+		cm.SendMessage(&Message{Type: ConnectRequest, Id: id})
+	}
+
+	// 51 bytes fits once, but not once for each connection
+	payload := &MessagePayload{"text": strings.Repeat("x", 40)}
+
+	var qbe *QueuedBytesError
+	err := cm.SendMessage(&Message{Type: BroadcastRequest, Payload: payload}).Err
+	if !errors.As(err, &qbe) || qbe.Size != 408 {
+		t.Errorf("expected QueuedBytesError for 408 bytes, got %v", err)
+	}
+
+	// nor for each of a connection's sessions
+	for _, session := range []string{"phone", "laptop"} {
+		cm.SendMessage(&Message{Type: PollRequest, Id: "a", Session: session, Timeout: time.Millisecond})
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	err = cm.SendMessage(&Message{Type: UnicastRequest, Id: "b", DestId: "a", Payload: payload}).Err
+	if !errors.As(err, &qbe) || qbe.Size != 102 {
+		t.Errorf("expected QueuedBytesError for 102 bytes, got %v", err)
+	}
+
+	// messages that skip the request check, like scheduled ones, are
+	// dropped where there's no room for them
+	scheduleTest(t, cm, time.Now(), &Message{Type: BroadcastRequest, Id: "b", Payload: payload})
+
+	dropped := 0
+	for _, id := range ids {
+		for _, d := range deadLettersTest(t, cm, id) {
+			if d.Reason == DeadLetterDropped {
+				dropped++
+			}
+		}
+	}
+
+	if dropped != len(ids)-1 {
+		t.Errorf("expected %d dropped, got %d", len(ids)-1, dropped)
+	}
+}
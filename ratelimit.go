@@ -0,0 +1,140 @@
+// Per-sender rate limits
+
+package connectionmanager
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// A token-bucket rate limit: a sender may make Burst requests at once,
+// and one more each 1/Rate seconds after that
+type RateLimit struct {
+	// sustained requests per second
+	Rate float64
+
+	// most requests allowed at once (0 is taken as 1)
+	Burst int
+}
+
+// Returned in the Err field of the response to a request that was over
+// its rate limit
+type RateLimitError struct {
+	// the throttled request's type and sender
+	Type MessageType
+	Id   string
+
+	// how long until the request would be allowed
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded for %s (message type %d): retry after %v", e.Id, e.Type, e.RetryAfter)
+}
+
+// Identifies a sender's bucket for one message type
+type rateKey struct {
+	id  string
+	typ MessageType
+}
+
+// A sender's remaining allowance
+type tokenBucket struct {
+	tokens float64
+
+	// when tokens was last brought up to date
+	last time.Time
+}
+
+// The most tokens a bucket can hold
+func (limit RateLimit) burst() float64 {
+	if limit.Burst < 1 {
+		return 1
+	}
+
+	return float64(limit.Burst)
+}
+
+// Add the tokens earned since the bucket was last updated
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(limit.burst(), b.tokens+elapsed*limit.Rate)
+		b.last = now
+	}
+}
+
+// Take a token if there is one
+//
+// Returns 0 on success, or how long until a token will be available.
+func (b *tokenBucket) take(limit RateLimit, now time.Time) time.Duration {
+	b.refill(limit, now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+
+	wait := (1 - b.tokens) / limit.Rate
+
+	return time.Duration(math.Ceil(wait * float64(time.Second)))
+}
+
+// Limit how often each sender can make requests of type t
+//
+// Senders are told apart by the request's Id. Requests over the limit
+// are refused with a *RateLimitError. A zero Rate removes the limit.
+// Must be called before SetActive(true).
+func (cm *Manager[T]) SetRateLimit(t MessageType, limit RateLimit) {
+	if limit.Rate <= 0 {
+		delete(cm.rateLimits, t)
+	} else {
+		cm.rateLimits[t] = limit
+	}
+}
+
+// Charge a request against its sender's rate limit
+//
+// Returns a *RateLimitError if it's over the limit.
+func (cm *Manager[T]) checkRate(m *TypedMessage[T], now time.Time) error {
+	// messages the manager sends itself aren't requests
+	if m.Type < 0 {
+		return nil
+	}
+
+	limit, ok := cm.rateLimits[m.Type]
+	if !ok {
+		return nil
+	}
+
+	key := rateKey{id: m.Id, typ: m.Type}
+
+	b, ok := cm.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: limit.burst(), last: now}
+		cm.buckets[key] = b
+	}
+
+	if wait := b.take(limit, now); wait > 0 {
+		cm.stats.Throttled++
+		return &RateLimitError{Type: m.Type, Id: m.Id, RetryAfter: wait}
+	}
+
+	return nil
+}
+
+// Forget buckets that have filled back up, since a new bucket would be
+// the same
+func (cm *Manager[T]) pruneBuckets(now time.Time) {
+	for key, b := range cm.buckets {
+		limit, ok := cm.rateLimits[key.typ]
+		if ok {
+			b.refill(limit, now)
+		}
+
+		if !ok || b.tokens >= limit.burst() {
+			delete(cm.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package connectionmanager
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	cm := New()
+	cm.SetRateLimit(BroadcastRequest, RateLimit{Rate: 20, Burst: 2})
+	cm.SetActive(true)
+	defer cm.SetActive(false)
+
+	cm.SendMessage(&Message{Type: ConnectRequest, Id: "alpha"})
+
+	broadcast := func(id string) error {
+		return cm.SendMessage(&Message{
+			Type:    BroadcastRequest,
+			Id:      id,
+			Payload: &MessagePayload{"text": "spam"},
+		}).Err
+	}
+
+	// the burst is allowed, then the sender is throttled
+	for i := 0; i < 2; i++ {
+		if err := broadcast("alpha"); err != nil {
+			t.Fatalf("broadcast %d: %v", i, err)
+		}
+	}
+
+	err := broadcast("alpha")
+
+	var rle *RateLimitError
+	if !errors.As(err, &rle) {
+		t.Fatalf("expected RateLimitError, got %v", err)
+	}
+
+	if rle.RetryAfter <= 0 || rle.RetryAfter > 50*time.Millisecond {
+		t.Errorf("unexpected RetryAfter %v", rle.RetryAfter)
+	}
+
+	// other senders and other message types have their own buckets
+	if err := broadcast("beta"); err != nil {
+		t.Errorf("beta: %v", err)
+	}
+
+	if err := cm.SendMessage(&Message{Type: UnicastRequest, Id: "alpha", DestId: "alpha"}).Err; err != nil {
+		t.Errorf("unicast: %v", err)
+	}
+
+	// and the bucket refills
+	time.Sleep(rle.RetryAfter)
+
+	if err := broadcast("alpha"); err != nil {
+		t.Errorf("after waiting: %v", err)
+	}
+
+	stats := cm.SendMessage(&Message{Type: StatsRequest}).General.(Stats)
+	if stats.Throttled != 1 {
+		t.Errorf("expected 1 throttled, got %d", stats.Throttled)
+	}
+}
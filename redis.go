@@ -0,0 +1,418 @@
+// Redis pub/sub backplane
+
+package connectionmanager
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix for the Redis channels a RedisBackplane uses, unless another
+// is given
+const DefaultRedisPrefix = "connectionmanager:"
+
+// How long to wait between attempts to reach Redis
+const redisRedialDelay = 500 * time.Millisecond
+
+// Mirrors a Manager's broadcasts and group publishes onto Redis pub/sub
+// channels, and delivers what's published there by others
+//
+// Broadcasts go to the channel <prefix>broadcast, and publishes to
+// group g go to <prefix>group:g. What's sent on the channels is just
+// the payload, encoded with the backplane's Codec, so other services
+// can publish and subscribe alongside the managers; a message's TTL and
+// priority don't make the trip.
+//
+// The backplane keeps two connections to Redis, one to publish on and
+// one to subscribe on, and reconnects them as needed. Publishes made
+// while Redis can't be reached are queued and sent once it can. Redis
+// sends a subscriber's own publishes back to it; those are recognized
+// and dropped.
+type RedisBackplane[T any] struct {
+	cm     *Manager[T]
+	addr   string
+	prefix string
+	codec  Codec
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	// publishes waiting to be sent, oldest first
+	outgoing []redisPublish
+
+	// true while the subscribing connection is subscribed; publishes
+	// are only sent then, so none of their echoes are missed
+	subscribed bool
+
+	// publishes sent whose echoes haven't come back yet, counted by
+	// redisPublish.key()
+	echoes map[string]int
+
+	// open connections, so Close can interrupt them
+	conns map[net.Conn]bool
+
+	closed bool
+
+	// running goroutines
+	wait sync.WaitGroup
+}
+
+// A message to publish on a channel
+type redisPublish struct {
+	channel string
+	data    []byte
+}
+
+// Identifies a publish, to match it with its echo
+func (p redisPublish) key() string {
+	return p.channel + "\x00" + string(p.data)
+}
+
+// Attach a Manager to a Redis server at addr (host:port), using
+// channels named with prefix and encoding payloads with codec
+//
+// Must be called before cm.SetActive(true). Connecting happens in the
+// background.
+func NewRedisBackplane[T any](cm *Manager[T], addr string, prefix string, codec Codec) *RedisBackplane[T] {
+	b := &RedisBackplane[T]{
+		cm:     cm,
+		addr:   addr,
+		prefix: prefix,
+		codec:  codec,
+		echoes: make(map[string]int),
+		conns:  make(map[net.Conn]bool),
+	}
+	b.cond = sync.NewCond(&b.lock)
+
+	cm.backplane = b
+
+	b.wait.Add(2)
+	go b.runPublisher()
+	go b.runSubscriber()
+
+	return b
+}
+
+// Disconnect from Redis, abandoning publishes not yet sent
+func (b *RedisBackplane[T]) Close() error {
+	b.lock.Lock()
+
+	if b.closed {
+		b.lock.Unlock()
+		return nil
+	}
+
+	b.closed = true
+
+	for conn := range b.conns {
+		conn.Close()
+	}
+
+	b.cond.Broadcast()
+	b.lock.Unlock()
+
+	b.wait.Wait()
+
+	return nil
+}
+
+// The channel for a group, or for broadcasts if group is ""
+func (b *RedisBackplane[T]) channel(group string) string {
+	if group == "" {
+		return b.prefix + "broadcast"
+	}
+
+	return b.prefix + "group:" + group
+}
+
+// Queue a broadcast or group publish that started on this node
+//
+// Called from the manager's goroutine. Returns the number of messages
+// that couldn't be queued (0 or 1).
+func (b *RedisBackplane[T]) publish(e *TypedEnvelope[T]) int {
+	data, err := b.codec.Marshal(e.payload)
+	if err != nil {
+		return 1
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return 1
+	}
+
+	b.outgoing = append(b.outgoing, redisPublish{channel: b.channel(e.group), data: data})
+	b.cond.Broadcast()
+
+	return 0
+}
+
+// Hand a message from Redis to the manager, unless it's the echo of
+// one of ours
+func (b *RedisBackplane[T]) receive(channel string, data []byte) {
+	key := redisPublish{channel: channel, data: data}.key()
+
+	b.lock.Lock()
+	if n := b.echoes[key]; n > 0 {
+		if n == 1 {
+			delete(b.echoes, key)
+		} else {
+			b.echoes[key] = n - 1
+		}
+
+		b.lock.Unlock()
+		return
+	}
+	b.lock.Unlock()
+
+	// Redis carries only the payload, so the message gets a new ID
+	// and no sender
+	e := &TypedEnvelope[T]{
+		id:        randomId(),
+		typ:       Broadcast,
+		timestamp: time.Now(),
+	}
+
+	if channel != b.channel("") {
+		e.typ = Publish
+		e.group = strings.TrimPrefix(channel, b.prefix+"group:")
+		if e.group == channel || e.group == "" {
+			return
+		}
+	}
+
+	// other services may publish things we can't read
+	if err := b.codec.Unmarshal(data, &e.payload); err != nil {
+		return
+	}
+
+	b.cm.SendMessage(&TypedMessage[T]{
+		Type:    backplanePublish,
+		General: e,
+	})
+}
+
+// Wait redisRedialDelay, or until the backplane is closed
+//
+// Returns false if it's been closed.
+func (b *RedisBackplane[T]) pause() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	deadline := time.Now().Add(redisRedialDelay)
+	timer := time.AfterFunc(redisRedialDelay, func() {
+		b.lock.Lock()
+		b.cond.Broadcast()
+		b.lock.Unlock()
+	})
+	defer timer.Stop()
+
+	for !b.closed && time.Now().Before(deadline) {
+		b.cond.Wait()
+	}
+
+	return !b.closed
+}
+
+// Connect to Redis, retrying until it works
+//
+// Returns nil if the backplane is closed first.
+func (b *RedisBackplane[T]) dial() net.Conn {
+	for {
+		conn, err := net.DialTimeout("tcp", b.addr, redisRedialDelay*4)
+
+		if err == nil {
+			b.lock.Lock()
+			closed := b.closed
+			if !closed {
+				b.conns[conn] = true
+			}
+			b.lock.Unlock()
+
+			if !closed {
+				return conn
+			}
+
+			conn.Close()
+		}
+
+		if !b.pause() {
+			return nil
+		}
+	}
+}
+
+// Stop tracking and close a connection
+func (b *RedisBackplane[T]) removeConn(conn net.Conn) {
+	b.lock.Lock()
+	delete(b.conns, conn)
+	b.lock.Unlock()
+
+	conn.Close()
+}
+
+// Send queued publishes, reconnecting as needed (runs as a goroutine)
+func (b *RedisBackplane[T]) runPublisher() {
+	defer b.wait.Done()
+
+	for {
+		conn := b.dial()
+		if conn == nil {
+			return
+		}
+
+		b.servePublisher(conn)
+		b.removeConn(conn)
+
+		if !b.pause() {
+			return
+		}
+	}
+}
+
+// Send queued publishes on a connection until it fails or the
+// backplane is closed
+//
+// A publish is only dropped from the queue once Redis has answered it,
+// so one interrupted by a failure is sent again and may arrive twice.
+func (b *RedisBackplane[T]) servePublisher(conn net.Conn) {
+	r := bufio.NewReader(conn)
+
+	for {
+		b.lock.Lock()
+		for !b.closed && (!b.subscribed || len(b.outgoing) == 0) {
+			b.cond.Wait()
+		}
+
+		if b.closed {
+			b.lock.Unlock()
+			return
+		}
+
+		p := b.outgoing[0]
+		b.echoes[p.key()]++
+		b.lock.Unlock()
+
+		cmd := respAppendCommand(nil, []byte("PUBLISH"), []byte(p.channel), p.data)
+
+		var reply interface{}
+		_, err := conn.Write(cmd)
+		if err == nil {
+			reply, err = respRead(r)
+		}
+
+		_, refused := reply.(respError)
+
+		b.lock.Lock()
+
+		// a refused publish won't echo, and won't work next time
+		// either
+		if err != nil || refused {
+			key := p.key()
+			if b.echoes[key]--; b.echoes[key] <= 0 {
+				delete(b.echoes, key)
+			}
+		}
+
+		if err == nil {
+			b.outgoing[0] = redisPublish{}
+			b.outgoing = b.outgoing[1:]
+		}
+
+		b.lock.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Receive publishes, resubscribing as needed (runs as a goroutine)
+func (b *RedisBackplane[T]) runSubscriber() {
+	defer b.wait.Done()
+
+	for {
+		conn := b.dial()
+		if conn == nil {
+			return
+		}
+
+		b.serveSubscriber(conn)
+
+		// echoes of anything sent now will never arrive
+		b.lock.Lock()
+		b.subscribed = false
+		b.echoes = make(map[string]int)
+		b.lock.Unlock()
+
+		b.removeConn(conn)
+
+		if !b.pause() {
+			return
+		}
+	}
+}
+
+// Subscribe on a connection and receive publishes until it fails
+func (b *RedisBackplane[T]) serveSubscriber(conn net.Conn) {
+	cmd := respAppendCommand(nil, []byte("SUBSCRIBE"), []byte(b.channel("")))
+	cmd = respAppendCommand(cmd, []byte("PSUBSCRIBE"), []byte(redisGlobEscape(b.prefix)+"group:*"))
+
+	if _, err := conn.Write(cmd); err != nil {
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	confirmed := 0
+
+	for {
+		v, err := respRead(r)
+		if err != nil {
+			return
+		}
+
+		a, ok := v.([]interface{})
+		if !ok || len(a) == 0 {
+			// an error reply means we aren't subscribed
+			return
+		}
+
+		switch respString(a[0]) {
+		case "subscribe", "psubscribe":
+			if confirmed++; confirmed == 2 {
+				b.lock.Lock()
+				b.subscribed = true
+				b.cond.Broadcast()
+				b.lock.Unlock()
+			}
+
+		case "message":
+			if data, ok := a[len(a)-1].([]byte); ok && len(a) == 3 {
+				b.receive(respString(a[1]), data)
+			}
+
+		case "pmessage":
+			if data, ok := a[len(a)-1].([]byte); ok && len(a) == 4 {
+				b.receive(respString(a[2]), data)
+			}
+		}
+	}
+}
+
+// Escape the characters Redis treats specially in a PSUBSCRIBE pattern
+func redisGlobEscape(s string) string {
+	var sb strings.Builder
+
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
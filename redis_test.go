@@ -0,0 +1,292 @@
+package connectionmanager
+
+import (
+	"bufio"
+	"net"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An in-process server speaking just enough RESP for a RedisBackplane
+type fakeRedis struct {
+	listener net.Listener
+
+	lock sync.Mutex
+
+	// connected clients, with their subscriptions
+	clients map[*fakeRedisClient]bool
+}
+
+// A connection to a fakeRedis
+type fakeRedisClient struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+	channels  map[string]bool
+	patterns  map[string]bool
+}
+
+// Start a fakeRedis on a free local port
+func startFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	s := &fakeRedis{
+		listener: listener,
+		clients:  make(map[*fakeRedisClient]bool),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			c := &fakeRedisClient{
+				conn:     conn,
+				channels: make(map[string]bool),
+				patterns: make(map[string]bool),
+			}
+
+			s.lock.Lock()
+			s.clients[c] = true
+			s.lock.Unlock()
+
+			go s.serve(c)
+		}
+	}()
+
+	return s
+}
+
+// Stop the server and disconnect everyone
+func (s *fakeRedis) close() {
+	s.listener.Close()
+	s.dropClients()
+}
+
+// Disconnect everyone, as if the server restarted
+func (s *fakeRedis) dropClients() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for c := range s.clients {
+		c.conn.Close()
+		delete(s.clients, c)
+	}
+}
+
+// Write a reply to a client
+func (c *fakeRedisClient) reply(data []byte) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.conn.Write(data)
+}
+
+// Build a reply array of bulk strings and integers
+func fakeRedisArray(values ...interface{}) []byte {
+	buf := []byte("*" + strconv.Itoa(len(values)) + "\r\n")
+
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			buf = respAppendBulk(buf, []byte(v))
+		case []byte:
+			buf = respAppendBulk(buf, v)
+		case int:
+			buf = append(buf, ":"+strconv.Itoa(v)+"\r\n"...)
+		}
+	}
+
+	return buf
+}
+
+// Run commands from a client (runs as a goroutine)
+func (s *fakeRedis) serve(c *fakeRedisClient) {
+	defer func() {
+		s.lock.Lock()
+		delete(s.clients, c)
+		s.lock.Unlock()
+
+		c.conn.Close()
+	}()
+
+	r := bufio.NewReader(c.conn)
+
+	for {
+		v, err := respRead(r)
+		if err != nil {
+			return
+		}
+
+		args, _ := v.([]interface{})
+		if len(args) == 0 {
+			c.reply([]byte("-ERR bad command\r\n"))
+			continue
+		}
+
+		switch respString(args[0]) {
+		case "SUBSCRIBE", "PSUBSCRIBE":
+			kind := "subscribe"
+			names := c.channels
+			if respString(args[0]) == "PSUBSCRIBE" {
+				kind = "psubscribe"
+				names = c.patterns
+			}
+
+			for _, arg := range args[1:] {
+				s.lock.Lock()
+				names[respString(arg)] = true
+				n := len(c.channels) + len(c.patterns)
+				s.lock.Unlock()
+
+				c.reply(fakeRedisArray(kind, respString(arg), n))
+			}
+
+		case "PUBLISH":
+			if len(args) != 3 {
+				c.reply([]byte("-ERR wrong number of arguments\r\n"))
+				continue
+			}
+
+			c.reply([]byte(":" + strconv.Itoa(s.publish(respString(args[1]), args[2].([]byte))) + "\r\n"))
+
+		default:
+			c.reply([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+// Send a message to every subscriber of a channel; returns the number
+// of subscribers
+func (s *fakeRedis) publish(channel string, data []byte) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := 0
+
+	for c := range s.clients {
+		if c.channels[channel] {
+			c.reply(fakeRedisArray("message", channel, data))
+			n++
+		}
+
+		for pattern := range c.patterns {
+			if ok, _ := path.Match(pattern, channel); ok {
+				c.reply(fakeRedisArray("pmessage", pattern, channel, data))
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+// Wait until a fakeRedis has n subscribed clients
+func waitForSubscribers(t *testing.T, s *fakeRedis, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+
+	for {
+		s.lock.Lock()
+		count := 0
+		for c := range s.clients {
+			if len(c.channels)+len(c.patterns) == 2 {
+				count++
+			}
+		}
+		s.lock.Unlock()
+
+		if count == n {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d subscribers, got %d", n, count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Start a manager with a backplane to s, and one connection
+func startBackplaneManager(t *testing.T, s *fakeRedis, id string) (*ConnectionManager, *RedisBackplane[*MessagePayload]) {
+	cm := New()
+	b := NewRedisBackplane(cm, s.listener.Addr().String(), DefaultRedisPrefix, JSONCodec)
+
+	cm.SetActive(true)
+	cm.SendMessage(&Message{Type: ConnectRequest, Id: id})
+
+	return cm, b
+}
+
+// Poll a connection for the expected messages
+func expectTexts(t *testing.T, cm *ConnectionManager, id string, texts ...string) {
+	got := payloadText(pollTest(t, cm, &Message{Id: id}))
+
+	if len(got) != len(texts) {
+		t.Fatalf("%s: expected %v, got %v", id, texts, got)
+	}
+
+	for i := range texts {
+		if got[i] != texts[i] {
+			t.Fatalf("%s: expected %v, got %v", id, texts, got)
+		}
+	}
+}
+
+func TestRedisBackplane(t *testing.T) {
+	s := startFakeRedis(t)
+	defer s.close()
+
+	a, ba := startBackplaneManager(t, s, "alice")
+	b, bb := startBackplaneManager(t, s, "bob")
+	defer a.SetActive(false)
+	defer b.SetActive(false)
+	defer ba.Close()
+	defer bb.Close()
+
+	waitForSubscribers(t, s, 2)
+
+	// broadcasts reach both managers, each exactly once
+	broadcastTest(t, a, &Message{Id: "alice"}, "one")
+	expectTexts(t, a, "alice", "one")
+	expectTexts(t, b, "bob", "one")
+
+	broadcastTest(t, a, &Message{Id: "alice"}, "two")
+	expectTexts(t, a, "alice", "two")
+	expectTexts(t, b, "bob", "two")
+
+	// group publishes only reach members
+	a.SendMessage(&Message{Type: SubscribeRequest, Id: "alice", Group: "rabbits"})
+
+	resp := b.SendMessage(&Message{
+		Type:    PublishRequest,
+		Id:      "bob",
+		Group:   "rabbits",
+		Payload: &MessagePayload{"text": "hop"},
+	})
+	if resp.Err != nil {
+		t.Fatalf("PublishRequest: %v", resp.Err)
+	}
+
+	broadcastTest(t, b, &Message{Id: "bob"}, "three")
+	expectTexts(t, a, "alice", "hop")
+	expectTexts(t, a, "alice", "three")
+	expectTexts(t, b, "bob", "three")
+
+	// other publishers are heard too
+	s.publish(DefaultRedisPrefix+"group:rabbits", []byte(`{"text":"outside"}`))
+	expectTexts(t, a, "alice", "outside")
+
+	// and publishing carries on after Redis restarts
+	s.dropClients()
+	waitForSubscribers(t, s, 2)
+	broadcastTest(t, a, &Message{Id: "alice"}, "four")
+	expectTexts(t, a, "alice", "four")
+	expectTexts(t, b, "bob", "four")
+}
@@ -0,0 +1,238 @@
+// Request/reply messaging between connections
+
+package connectionmanager
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// How long a query waits for its reply, unless told otherwise
+const defaultQueryTimeout = 30 * time.Second
+
+// A query waiting for its reply
+type pendingQuery[T any] struct {
+	// the asker, and the connection expected to answer, as the asker
+	// named it and by its ID
+	id        string
+	destId    string
+	responder string
+
+	// where the reply goes: a connection's queue, or replyChan if the
+	// asker is waiting on it
+	replyTo   string
+	replyChan chan *TypedMessage[T]
+
+	timeout time.Duration
+
+	// fires when the query times out
+	timer *time.Timer
+}
+
+// Sent in the Err field of a QueryResponse on a query's ReplyChan when
+// no reply came in time
+type QueryTimeoutError struct {
+	// the query's correlation ID, asker and destination
+	CorrelationId string
+	Id            string
+	DestId        string
+
+	// how long it waited
+	Timeout time.Duration
+}
+
+func (e *QueryTimeoutError) Error() string {
+	return fmt.Sprintf("query %s from %s to %s timed out after %v", e.CorrelationId, e.Id, e.DestId, e.Timeout)
+}
+
+// Ask another connection a question and wait for the answer
+//
+// m is sent as a QueryRequest: Id is the asker, DestId the connection
+// to ask, and Timeout how long to wait (0 means 30 seconds). The reply
+// is returned as it would have been delivered, or the error if the
+// query was refused or timed out (a *QueryTimeoutError).
+//
+// To be called from other threads.
+func (cm *Manager[T]) Ask(m *TypedMessage[T]) (*TypedEnvelope[T], error) {
+	m.Type = QueryRequest
+	m.ReplyChan = make(chan *TypedMessage[T], 1)
+
+	resp := cm.SendMessage(m)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+
+	reply := <-m.ReplyChan
+	if reply.Err != nil {
+		return nil, reply.Err
+	}
+
+	return reply.Envelope, nil
+}
+
+// Handle a QueryRequest Message
+//
+// Message.DestId should be set to the recipient's ID. The recipient
+// gets a Query carrying the CorrelationId (made up if it's not given)
+// and ReplyTo (the asker, if it's not given), and answers with a
+// ReplyRequest. The CorrelationId is returned in the QueryResponse. If
+// Message.ReplyChan is set, which must have room for it, a second
+// QueryResponse is sent there with the reply in its Envelope field, or
+// a *QueryTimeoutError; otherwise the reply is queued for ReplyTo.
+func (cm *Manager[T]) handleQueryRequest(m *TypedMessage[T]) {
+	var err error
+
+	sender := cm.publicId(m.Id)
+
+	replyTo := m.ReplyTo
+	if replyTo == "" {
+		replyTo = sender
+	}
+
+	correlationId := m.CorrelationId
+	if correlationId == "" {
+		correlationId = randomId()
+	}
+
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = defaultQueryTimeout
+	}
+
+	c, ok := cm.findConnection(m.DestId)
+
+	if !ok {
+		err = errors.New(fmt.Sprintf("QueryRequest: unknown destination id: %s", m.DestId))
+	} else if _, ok := cm.findConnection(replyTo); !ok && m.ReplyChan == nil {
+		err = errors.New(fmt.Sprintf("QueryRequest: unknown reply-to id: %s", replyTo))
+	} else if _, ok := cm.queries[correlationId]; ok {
+		err = errors.New(fmt.Sprintf("QueryRequest: correlation id in use: %s", correlationId))
+	} else {
+		err = cm.checkPayload(m, c.queues())
+	}
+
+	if err != nil {
+		m.RChan <- &TypedMessage[T]{
+			Type: QueryResponse,
+			Err:  err,
+		}
+
+		return
+	}
+
+	e := cm.seal(m, Query)
+	e.correlationId = correlationId
+	e.replyTo = replyTo
+
+	// a query nobody can answer any more isn't worth delivering
+	if e.ttl == 0 || e.ttl > timeout {
+		e.ttl = timeout
+	}
+
+	// replies only come in through the manager's goroutine, so the
+	// query can wait to be recorded until it's been queued
+	if err := cm.deliver(c, e); err != nil {
+		m.RChan <- &TypedMessage[T]{
+			Type: QueryResponse,
+			Err:  err,
+		}
+
+		return
+	}
+
+	q := &pendingQuery[T]{
+		id:        sender,
+		destId:    m.DestId,
+		responder: c.id,
+		replyTo:   replyTo,
+		replyChan: m.ReplyChan,
+		timeout:   timeout,
+	}
+
+	q.timer = time.AfterFunc(timeout, func() {
+		cm.messageChannel <- &TypedMessage[T]{
+			Type:          queryTimeout,
+			CorrelationId: correlationId,
+			General:       q,
+		}
+	})
+
+	cm.queries[correlationId] = q
+
+	m.RChan <- &TypedMessage[T]{
+		Type:          QueryResponse,
+		CorrelationId: correlationId,
+		Err:           nil,
+	}
+}
+
+// Handle a ReplyRequest Message
+//
+// Message.Id should be set to the ID the query was sent to, and
+// Message.CorrelationId to the query's.
+func (cm *Manager[T]) handleReplyRequest(m *TypedMessage[T]) {
+	var err error
+
+	q, ok := cm.queries[m.CorrelationId]
+
+	if !ok {
+		err = errors.New(fmt.Sprintf("ReplyRequest: no query pending: %s", m.CorrelationId))
+	} else if c, ok := cm.findConnection(m.Id); !ok || c.id != q.responder {
+		err = errors.New(fmt.Sprintf("ReplyRequest: query %s wasn't sent to %s", m.CorrelationId, m.Id))
+	} else if q.replyChan == nil {
+		err = cm.checkPayload(m, cm.copiesFor(q.replyTo))
+	}
+
+	if err == nil {
+		q.timer.Stop()
+		delete(cm.queries, m.CorrelationId)
+
+		e := cm.seal(m, Reply)
+		e.destId = q.replyTo
+
+		if q.replyChan != nil {
+			q.replyChan <- &TypedMessage[T]{
+				Type:          QueryResponse,
+				CorrelationId: m.CorrelationId,
+				Envelope:      e,
+			}
+		} else if c, ok := cm.findConnection(q.replyTo); ok {
+			err = cm.deliver(c, e)
+		} else {
+			err = errors.New(fmt.Sprintf("ReplyRequest: reply-to id has disconnected: %s", q.replyTo))
+		}
+	}
+
+	m.RChan <- &TypedMessage[T]{
+		Type: ReplyResponse,
+		Err:  err,
+	}
+}
+
+// Handle a queryTimeout Message
+//
+// Sent by a query's timer when no reply came in time; a waiting asker
+// gets a *QueryTimeoutError, and later replies are refused.
+func (cm *Manager[T]) handleQueryTimeout(m *TypedMessage[T]) {
+	q, ok := cm.queries[m.CorrelationId]
+	if !ok || q != m.General {
+		// answered just in time
+		return
+	}
+
+	delete(cm.queries, m.CorrelationId)
+
+	if q.replyChan != nil {
+		q.replyChan <- &TypedMessage[T]{
+			Type:          QueryResponse,
+			CorrelationId: m.CorrelationId,
+			Err: &QueryTimeoutError{
+				CorrelationId: m.CorrelationId,
+				Id:            q.id,
+				DestId:        q.destId,
+				Timeout:       q.timeout,
+			},
+		}
+	}
+}
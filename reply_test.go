@@ -0,0 +1,109 @@
+package connectionmanager
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQueryReply(t *testing.T) {
+	cm := startTestManager(t, "asker", "bot", "inbox")
+	defer cm.SetActive(false)
+
+	// the bot answers each query it polls with the question shouted
+	go func() {
+		for {
+			resp := cm.SendMessage(&Message{Type: PollRequest, Id: "bot"})
+			if resp.Err != nil {
+				return
+			}
+
+			batch, ok := <-resp.PollChan
+			if !ok {
+				return
+			}
+
+			for _, e := range *batch {
+				if e.Type() != Query || (*e.Payload())["text"] == "ignore me" {
+					continue
+				}
+
+				cm.SendMessage(&Message{
+					Type:          ReplyRequest,
+					Id:            "bot",
+					CorrelationId: e.CorrelationId(),
+					Payload:       &MessagePayload{"text": (*e.Payload())["text"].(string) + "!"},
+				})
+			}
+		}
+	}()
+
+	reply, err := cm.Ask(&Message{Id: "asker", DestId: "bot", Payload: &MessagePayload{"text": "hello"}})
+	if err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+
+	if reply.Type() != Reply || reply.Sender() != "bot" || (*reply.Payload())["text"] != "hello!" {
+		t.Errorf("expected a reply of hello! from bot, got %v", reply)
+	}
+
+	// a reply can go to another connection's queue instead
+	resp := cm.SendMessage(&Message{
+		Type:          QueryRequest,
+		Id:            "asker",
+		DestId:        "bot",
+		ReplyTo:       "inbox",
+		CorrelationId: "q1",
+		Payload:       &MessagePayload{"text": "where"},
+	})
+	if resp.Err != nil || resp.CorrelationId != "q1" {
+		t.Fatalf("QueryRequest: %v %q", resp.Err, resp.CorrelationId)
+	}
+
+	batch := pollTest(t, cm, &Message{Id: "inbox"})
+	if len(batch) != 1 || batch[0].Type() != Reply || batch[0].CorrelationId() != "q1" {
+		t.Fatalf("inbox: expected the reply to q1, got %v", batch)
+	}
+
+	// an unanswered query times out, and late replies are refused
+	_, err = cm.Ask(&Message{
+		Id:            "asker",
+		DestId:        "bot",
+		CorrelationId: "q2",
+		Timeout:       50 * time.Millisecond,
+		Payload:       &MessagePayload{"text": "ignore me"},
+	})
+
+	var qte *QueryTimeoutError
+	if !errors.As(err, &qte) || qte.CorrelationId != "q2" || qte.DestId != "bot" {
+		t.Errorf("expected QueryTimeoutError for q2, got %v", err)
+	}
+
+	resp = cm.SendMessage(&Message{Type: ReplyRequest, Id: "bot", CorrelationId: "q2"})
+	if resp.Err == nil {
+		t.Errorf("expected error replying to a timed-out query")
+	}
+
+	resp = cm.SendMessage(&Message{Type: QueryRequest, Id: "asker", DestId: "nobody"})
+	if resp.Err == nil {
+		t.Errorf("expected error querying unknown id")
+	}
+}
+
+func TestQueryShutdown(t *testing.T) {
+	cm := startTestManager(t, "asker", "bot")
+
+	resp := cm.SendMessage(&Message{Type: QueryRequest, Id: "asker", DestId: "bot", Timeout: 20 * time.Millisecond})
+	if resp.Err != nil {
+		t.Fatalf("QueryRequest: %v", resp.Err)
+	}
+
+	cm.SetActive(false)
+
+	// nothing is left to time out once the manager has stopped
+	time.Sleep(50 * time.Millisecond)
+
+	if len(cm.queries) != 0 || len(cm.messageChannel) != 0 {
+		t.Errorf("expected no queries or timeouts after stopping, got %d and %d", len(cm.queries), len(cm.messageChannel))
+	}
+}
@@ -0,0 +1,149 @@
+// Redis serialization protocol (RESP)
+
+package connectionmanager
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Largest bulk string or array a RESP reader will accept (Redis's own
+// limit for bulk strings)
+const respMaxLength = 512 << 20
+
+// An error reply from a RESP server
+type respError string
+
+func (e respError) Error() string {
+	return "redis: " + string(e)
+}
+
+// Append a command to buf, as an array of bulk strings
+func respAppendCommand(buf []byte, args ...[]byte) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+
+	for _, arg := range args {
+		buf = respAppendBulk(buf, arg)
+	}
+
+	return buf
+}
+
+// Append a bulk string to buf
+func respAppendBulk(buf []byte, data []byte) []byte {
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(data)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, data...)
+
+	return append(buf, '\r', '\n')
+}
+
+// Read a line, without its CRLF
+func respReadLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errors.New("RESP: line not terminated by CRLF")
+	}
+
+	return line[:len(line)-2], nil
+}
+
+// Read a length, which may be -1 for a null
+func respReadLength(r *bufio.Reader) (int, error) {
+	line, err := respReadLine(r)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(string(line))
+	if err != nil || n < -1 || n > respMaxLength {
+		return 0, errors.New(fmt.Sprintf("RESP: bad length: %q", line))
+	}
+
+	return n, nil
+}
+
+// Read one value
+//
+// Simple strings are returned as string, errors as respError, integers
+// as int64, bulk strings as []byte and arrays as []interface{}. Nulls
+// are returned as nil.
+func respRead(r *bufio.Reader) (interface{}, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case '+':
+		line, err := respReadLine(r)
+		return string(line), err
+
+	case '-':
+		line, err := respReadLine(r)
+		return respError(line), err
+
+	case ':':
+		line, err := respReadLine(r)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.ParseInt(string(line), 10, 64)
+
+	case '$':
+		n, err := respReadLength(r)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+
+		if data[n] != '\r' || data[n+1] != '\n' {
+			return nil, errors.New("RESP: bulk string not terminated by CRLF")
+		}
+
+		return data[:n], nil
+
+	case '*':
+		n, err := respReadLength(r)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = respRead(r); err != nil {
+				return nil, err
+			}
+		}
+
+		return values, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("RESP: unknown type: %q", kind))
+}
+
+// Return the bulk or simple string in a value, or "" if it's neither
+func respString(v interface{}) string {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+
+	return ""
+}
@@ -0,0 +1,354 @@
+// Scheduled and delayed message delivery
+
+package connectionmanager
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A message waiting for its delivery time
+type scheduledMessage[T any] struct {
+	// ID used to cancel or list this message
+	id string
+
+	// when to deliver
+	at time.Time
+
+	// the BroadcastRequest or UnicastRequest to deliver
+	message *TypedMessage[T]
+
+	// position in the scheduleHeap
+	index int
+}
+
+// Information about a pending scheduled message, returned in the
+// General field of a ScheduledResponse
+type TypedScheduledMessage[T any] struct {
+	// ID of the scheduled message
+	Id string
+
+	// When it will be delivered
+	At time.Time
+
+	// The BroadcastRequest or UnicastRequest that will be delivered
+	Message TypedMessage[T]
+}
+
+// Scheduled messages with map payloads, as used by ConnectionManager
+type ScheduledMessage = TypedScheduledMessage[*MessagePayload]
+
+// Form of a scheduled message in a Store
+//
+// The payload is encoded with the manager's Codec, named in Codec so it
+// can be read back even if the manager's codec has since changed.
+type storedSchedule struct {
+	At       time.Time
+	Type     MessageType
+	Id       string
+	DestId   string
+	Codec    string
+	Payload  []byte
+	TTL      time.Duration
+	Priority int
+}
+
+// Min-heap of scheduled messages, earliest first (implements
+// heap.Interface)
+type scheduleHeap[T any] []*scheduledMessage[T]
+
+func (h scheduleHeap[T]) Len() int { return len(h) }
+
+func (h scheduleHeap[T]) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h scheduleHeap[T]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *scheduleHeap[T]) Push(x interface{}) {
+	s := x.(*scheduledMessage[T])
+	s.index = len(*h)
+	*h = append(*h, s)
+}
+
+func (h *scheduleHeap[T]) Pop() interface{} {
+	old := *h
+	n := len(old)
+	s := old[n-1]
+	old[n-1] = nil
+	s.index = -1
+	*h = old[:n-1]
+	return s
+}
+
+// Encode a scheduled message for a Store
+func encodeScheduled[T any](s *scheduledMessage[T], codec Codec) ([]byte, error) {
+	m := s.message
+
+	payload, err := codec.Marshal(m.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&storedSchedule{
+		At:       s.at,
+		Type:     m.Type,
+		Id:       m.Id,
+		DestId:   m.DestId,
+		Codec:    codec.Name(),
+		Payload:  payload,
+		TTL:      m.TTL,
+		Priority: m.Priority,
+	})
+}
+
+// Decode a scheduled message from a Store
+func decodeScheduled[T any](id string, data []byte) (*scheduledMessage[T], error) {
+	var st storedSchedule
+
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+
+	codec, err := CodecByName(st.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload T
+	if err := codec.Unmarshal(st.Payload, &payload); err != nil {
+		return nil, err
+	}
+
+	return &scheduledMessage[T]{
+		id: id,
+		at: st.At,
+		message: &TypedMessage[T]{
+			Type:     st.Type,
+			Id:       st.Id,
+			DestId:   st.DestId,
+			Payload:  payload,
+			TTL:      st.TTL,
+			Priority: st.Priority,
+		},
+	}, nil
+}
+
+// Set a Store for persisting manager state
+//
+// Scheduled messages saved in the store are loaded immediately. Must be
+// called before SetActive(true).
+func (cm *Manager[T]) SetStore(store Store) error {
+	saved, err := store.LoadScheduled()
+	if err != nil {
+		return err
+	}
+
+	for id, data := range saved {
+		s, err := decodeScheduled[T](id, data)
+		if err != nil {
+			return errors.New(fmt.Sprintf("SetStore: scheduled message %s: %v", id, err))
+		}
+
+		if _, present := cm.scheduled[id]; !present {
+			cm.scheduled[id] = s
+			heap.Push(&cm.schedule, s)
+		}
+	}
+
+	cm.store = store
+
+	return nil
+}
+
+// Point the schedule timer at the earliest scheduled message
+func (cm *Manager[T]) resetScheduleTimer() {
+	if !cm.scheduleTimer.Stop() {
+		// drain a fire we haven't handled yet
+		select {
+		case <-cm.scheduleTimer.C:
+		default:
+		}
+	}
+
+	if len(cm.schedule) > 0 {
+		cm.scheduleTimer.Reset(time.Until(cm.schedule[0].at))
+	}
+}
+
+// Remove a scheduled message from tracking and storage
+func (cm *Manager[T]) unschedule(s *scheduledMessage[T]) error {
+	heap.Remove(&cm.schedule, s.index)
+	delete(cm.scheduled, s.id)
+
+	if cm.store != nil {
+		return cm.store.DeleteScheduled(s.id)
+	}
+
+	return nil
+}
+
+// Deliver all scheduled messages that are due
+func (cm *Manager[T]) deliverScheduled(now time.Time) {
+	for len(cm.schedule) > 0 && !cm.schedule[0].at.After(now) {
+		s := cm.schedule[0]
+
+		// a store failure here can only cause a duplicate after a
+		// restart, so carry on with delivery
+		cm.unschedule(s)
+
+		m := s.message
+
+		switch m.Type {
+		case BroadcastRequest:
+			cm.publish(cm.seal(m, Broadcast))
+
+		case UnicastRequest:
+			// the recipient may have gone away, and there's nobody
+			// waiting to be told
+			if e := cm.seal(m, Unicast); cm.unicast(e) != nil {
+				cm.deadLetters.add(e, DeadLetterUndeliverable, e.destId, "")
+			}
+		}
+	}
+
+	cm.resetScheduleTimer()
+}
+
+// Handle a ScheduleRequest Message
+//
+// Message.General should be a *Message of type BroadcastRequest or
+// UnicastRequest, which will be delivered at Message.At. The ID of the
+// scheduled message is returned in the response's Id field.
+func (cm *Manager[T]) handleScheduleRequest(m *TypedMessage[T]) {
+	sm, ok := m.General.(*TypedMessage[T])
+
+	if !ok || (sm.Type != BroadcastRequest && sm.Type != UnicastRequest) {
+		m.RChan <- &TypedMessage[T]{
+			Type: ScheduleResponse,
+			Err:  errors.New("ScheduleRequest: General must be a BroadcastRequest or UnicastRequest *TypedMessage[T]"),
+		}
+
+		return
+	}
+
+	// keep a copy, so the caller's message is left alone and can't
+	// change before it's due
+	scheduled := *sm
+	sm = &scheduled
+
+	var err error
+	if sm.Type == BroadcastRequest {
+		err = checkBroadcast(sm)
+	}
+
+	// there's no telling what will be queued by the time it's due, so
+	// only the payload size is checked now
+	if err == nil {
+		err = cm.checkPayload(sm, 0)
+	}
+
+	if err != nil {
+		m.RChan <- &TypedMessage[T]{
+			Type: ScheduleResponse,
+			Err:  err,
+		}
+
+		return
+	}
+
+	s := &scheduledMessage[T]{
+		id:      randomId(),
+		at:      m.At,
+		message: sm,
+	}
+
+	if cm.store != nil {
+		data, err := encodeScheduled(s, cm.codec)
+		if err == nil {
+			err = cm.store.SaveScheduled(s.id, data)
+		}
+
+		if err != nil {
+			m.RChan <- &TypedMessage[T]{
+				Type: ScheduleResponse,
+				Err:  errors.New(fmt.Sprintf("ScheduleRequest: store: %v", err)),
+			}
+
+			return
+		}
+	}
+
+	cm.scheduled[s.id] = s
+	heap.Push(&cm.schedule, s)
+
+	m.RChan <- &TypedMessage[T]{
+		Type: ScheduleResponse,
+		Id:   s.id,
+		Err:  nil,
+	}
+
+	// deliver right away if it's already due
+	cm.deliverScheduled(time.Now())
+}
+
+// Handle a CancelRequest Message
+//
+// Message.Id should be the ID returned in the ScheduleResponse.
+func (cm *Manager[T]) handleCancelRequest(m *TypedMessage[T]) {
+	var err error
+
+	s, ok := cm.scheduled[m.Id]
+
+	if ok {
+		err = cm.unschedule(s)
+		cm.resetScheduleTimer()
+	} else {
+		err = errors.New(fmt.Sprintf("CancelRequest: unknown scheduled message id: %s", m.Id))
+	}
+
+	m.RChan <- &TypedMessage[T]{
+		Type: CancelResponse,
+		Id:   m.Id,
+		Err:  err,
+	}
+}
+
+// Handle a ScheduledRequest Message
+//
+// A []TypedScheduledMessage of pending messages, earliest first, is
+// returned in the General field. If Message.Id is set, only the
+// messages scheduled by that connection are listed. The listed
+// messages' Credentials are left out.
+func (cm *Manager[T]) handleScheduledRequest(m *TypedMessage[T]) {
+	r := make([]TypedScheduledMessage[T], 0, len(cm.schedule))
+
+	for _, s := range cm.schedule {
+		if m.Id != "" && s.message.Id != m.Id {
+			continue
+		}
+
+		sm := *s.message
+		sm.Credentials = nil
+
+		r = append(r, TypedScheduledMessage[T]{
+			Id:      s.id,
+			At:      s.at,
+			Message: sm,
+		})
+	}
+
+	sort.Slice(r, func(i, j int) bool { return r[i].At.Before(r[j].At) })
+
+	m.RChan <- &TypedMessage[T]{
+		Type:    ScheduledResponse,
+		General: r,
+		Err:     nil,
+	}
+}
@@ -0,0 +1,113 @@
+package connectionmanager
+
+import (
+	"testing"
+	"time"
+)
+
+// Schedule a message and return its ID
+func scheduleTest(t *testing.T, cm *ConnectionManager, at time.Time, m *Message) string {
+	resp := cm.SendMessage(&Message{
+		Type:    ScheduleRequest,
+		At:      at,
+		General: m,
+	})
+
+	if resp.Err != nil {
+		t.Fatalf("ScheduleRequest: %v", resp.Err)
+	}
+
+	return resp.Id
+}
+
+func TestScheduledDelivery(t *testing.T) {
+	cm := startTestManager(t, "alpha", "bravo")
+	defer cm.SetActive(false)
+
+	now := time.Now()
+
+	scheduleTest(t, cm, now.Add(40*time.Millisecond), &Message{
+		Type:    BroadcastRequest,
+		Id:      "alpha",
+		Payload: &MessagePayload{"text": "later"},
+	})
+	scheduleTest(t, cm, now.Add(20*time.Millisecond), &Message{
+		Type:    UnicastRequest,
+		Id:      "alpha",
+		DestId:  "bravo",
+		Payload: &MessagePayload{"text": "sooner"},
+	})
+	cancelId := scheduleTest(t, cm, now.Add(30*time.Millisecond), &Message{
+		Type:    BroadcastRequest,
+		Id:      "alpha",
+		Payload: &MessagePayload{"text": "canceled"},
+	})
+
+	list := cm.SendMessage(&Message{Type: ScheduledRequest}).General.([]ScheduledMessage)
+	if len(list) != 3 || list[0].Message.Type != UnicastRequest {
+		t.Fatalf("unexpected schedule list: %v", list)
+	}
+
+	if resp := cm.SendMessage(&Message{Type: CancelRequest, Id: cancelId}); resp.Err != nil {
+		t.Fatalf("CancelRequest: %v", resp.Err)
+	}
+
+	batch := payloadText(pollTest(t, cm, &Message{Id: "bravo"}))
+	if len(batch) != 1 || batch[0] != "sooner" {
+		t.Errorf("expected [sooner], got %v", batch)
+	}
+
+	batch = payloadText(pollTest(t, cm, &Message{Id: "bravo"}))
+	if len(batch) != 1 || batch[0] != "later" {
+		t.Errorf("expected [later], got %v", batch)
+	}
+
+	batch = payloadText(pollTest(t, cm, &Message{Id: "alpha"}))
+	if len(batch) != 1 || batch[0] != "later" {
+		t.Errorf("expected [later], got %v", batch)
+	}
+}
+
+func TestScheduledPersistence(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+
+	cm := New()
+	cm.SetCodec(BinaryCodec)
+	if err := cm.SetStore(store); err != nil {
+		t.Fatalf("SetStore: %v", err)
+	}
+	cm.SetActive(true)
+
+	id := scheduleTest(t, cm, time.Now().Add(time.Hour), &Message{
+		Type:     BroadcastRequest,
+		Id:       "alpha",
+		Priority: 2,
+		Payload:  &MessagePayload{"text": "reminder"},
+	})
+
+	cm.SetActive(false)
+
+	// a new manager on the same store picks up the pending message,
+	// even though it uses a different codec
+	cm = New()
+	if err := cm.SetStore(store); err != nil {
+		t.Fatalf("SetStore: %v", err)
+	}
+	cm.SetActive(true)
+	defer cm.SetActive(false)
+
+	list := cm.SendMessage(&Message{Type: ScheduledRequest}).General.([]ScheduledMessage)
+	if len(list) != 1 || list[0].Id != id || list[0].Message.Priority != 2 || (*list[0].Message.Payload)["text"] != "reminder" {
+		t.Fatalf("unexpected schedule list: %v", list)
+	}
+
+	cm.SendMessage(&Message{Type: CancelRequest, Id: id})
+
+	saved, err := store.LoadScheduled()
+	if err != nil || len(saved) != 0 {
+		t.Errorf("expected empty store after cancel, got %v %v", saved, err)
+	}
+}
@@ -0,0 +1,142 @@
+// Server-Sent Events delivery handler
+
+package connectionmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How often an SSEHandler sends a comment to keep a quiet stream open,
+// unless told otherwise
+const sseHeartbeatInterval = 15 * time.Second
+
+// Streams a connection's messages as Server-Sent Events (implements
+// http.Handler)
+//
+// The stream belongs to the connection named by the "id" parameter of
+// the request, which must already exist, and to the "session"
+// parameter if it's given. Credentials for the manager's Authorizer
+// come from the "token" parameter. Each message is sent as one event, with the
+// message's sequence number as its ID and, as its data, a JSON object
+// in the same form as a LineServer poll's messages:
+//
+//	id: 42
+//	data: {"type":"broadcast","id":"alice","payload":{"text":"hi"}}
+//
+// A client that reconnects with a Last-Event-ID header is sent again
+// whatever its session was sent after that event, as far as the
+// session remembers. A comment is sent when the stream has been quiet
+// for a while, so proxies don't close it.
+type SSEHandler[T any] struct {
+	cm *Manager[T]
+
+	// How long the stream can be quiet before a comment is sent (0
+	// means 15 seconds)
+	Heartbeat time.Duration
+}
+
+// Create an SSEHandler for a Manager
+func NewSSEHandler[T any](cm *Manager[T]) *SSEHandler[T] {
+	return &SSEHandler[T]{cm: cm}
+}
+
+// Start a poll for the stream's connection
+func (h *SSEHandler[T]) poll(id string, session string, credentials interface{}, after uint64) *TypedMessage[T] {
+	heartbeat := h.Heartbeat
+	if heartbeat == 0 {
+		heartbeat = sseHeartbeatInterval
+	}
+
+	return h.cm.SendMessage(&TypedMessage[T]{
+		Type:        PollRequest,
+		Id:          id,
+		Session:     session,
+		Credentials: credentials,
+		Seq:         after,
+		Timeout:     heartbeat,
+	})
+}
+
+// Stream events until the client goes away or the connection is
+// disconnected
+func (h *SSEHandler[T]) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
+	id := rq.FormValue("id")
+	session := rq.FormValue("session")
+	credentials := requestCredentials(rq)
+
+	// an unparseable Last-Event-ID just means starting afresh
+	after, _ := strconv.ParseUint(rq.Header.Get("Last-Event-ID"), 10, 64)
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	resp := h.poll(id, session, credentials, after)
+	if resp.Err != nil {
+		http.Error(rw, resp.Err.Error(), pollErrorStatus(resp.Err))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		var batch *[]*TypedEnvelope[T]
+
+		select {
+		case batch, ok = <-resp.PollChan:
+			if !ok {
+				return
+			}
+
+		case <-rq.Context().Done():
+			// the client has gone; don't let the next batch go with it
+			h.cm.SendMessage(&TypedMessage[T]{
+				Type:        AbandonRequest,
+				Id:          id,
+				Session:     session,
+				PollChan:    resp.PollChan,
+				Credentials: credentials,
+			})
+
+			return
+		}
+
+		var err error
+
+		if len(*batch) == 0 {
+			_, err = fmt.Fprint(rw, ": heartbeat\n\n")
+		}
+
+		for _, e := range *batch {
+			var data []byte
+
+			if data, err = json.Marshal(newLineMessage(e, JSONCodec)); err == nil {
+				_, err = fmt.Fprintf(rw, "id: %d\ndata: %s\n\n", e.Seq(), data)
+			}
+
+			if err != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			return
+		}
+
+		flusher.Flush()
+
+		if resp = h.poll(id, session, credentials, 0); resp.Err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package connectionmanager
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Read an event (or comment) from a stream, as its lines
+func readEvent(t *testing.T, r *bufio.Reader) []string {
+	var lines []string
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				return
+			}
+
+			lines = append(lines, line)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for event")
+	}
+
+	return lines
+}
+
+// Open an event stream
+func openStream(t *testing.T, server *httptest.Server, query string, lastEventId string) (*http.Response, *bufio.Reader) {
+	rq, _ := http.NewRequest("GET", server.URL+"?"+query, nil)
+	if lastEventId != "" {
+		rq.Header.Set("Last-Event-ID", lastEventId)
+	}
+
+	resp, err := http.DefaultClient.Do(rq)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func TestSSEHandler(t *testing.T) {
+	cm := startTestManager(t, "alice")
+	defer cm.SetActive(false)
+
+	h := NewSSEHandler(cm)
+	h.Heartbeat = 20 * time.Millisecond
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?id=nobody")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown id, got %d", resp.StatusCode)
+	}
+
+	resp, r := openStream(t, server, "id=alice", "")
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected text/event-stream, got %q", ct)
+	}
+
+	broadcastTest(t, cm, &Message{Id: "alice"}, "one")
+	broadcastTest(t, cm, &Message{Id: "alice"}, "two")
+
+	events := [][]string{readEvent(t, r), readEvent(t, r)}
+
+	if events[0][0] != "id: 1" || !strings.Contains(events[0][1], `"text":"one"`) {
+		t.Errorf("unexpected event %q", events[0])
+	}
+	if events[1][0] != "id: 2" || !strings.Contains(events[1][1], `"text":"two"`) {
+		t.Errorf("unexpected event %q", events[1])
+	}
+
+	// quiet streams get heartbeats
+	if e := readEvent(t, r); len(e) != 1 || !strings.HasPrefix(e[0], ":") {
+		t.Errorf("expected heartbeat, got %q", e)
+	}
+
+	resp.Body.Close()
+
+	// reconnecting after event 1 gets event 2 again, then carries on
+	resp, r = openStream(t, server, "id=alice", "1")
+	defer resp.Body.Close()
+
+	if e := readEvent(t, r); e[0] != "id: 2" {
+		t.Errorf("expected event 2 again, got %q", e)
+	}
+
+	broadcastTest(t, cm, &Message{Id: "alice"}, "three")
+
+	for {
+		e := readEvent(t, r)
+		if strings.HasPrefix(e[0], ":") {
+			continue
+		}
+
+		if e[0] != "id: 3" {
+			t.Errorf("expected event 3, got %q", e)
+		}
+		break
+	}
+}
+
+func TestSSEAbandon(t *testing.T) {
+	cm := startTestManager(t, "alice")
+	defer cm.SetActive(false)
+
+	// note when the handler's done with the stream
+	h := NewSSEHandler(cm)
+	served := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		h.ServeHTTP(rw, rq)
+		served <- struct{}{}
+	}))
+	defer server.Close()
+
+	// a client that closes its stream...
+	resp, _ := openStream(t, server, "id=alice", "")
+	resp.Body.Close()
+
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("handler never noticed the stream closing")
+	}
+
+	// ...doesn't take the next message with it
+	broadcastTest(t, cm, &Message{Id: "bob"}, "hi")
+
+	if texts := payloadText(pollTest(t, cm, &Message{Id: "alice"})); len(texts) != 1 || texts[0] != "hi" {
+		t.Errorf("expected [hi], got %v", texts)
+	}
+}
@@ -0,0 +1,95 @@
+// Persistent storage for manager state
+
+package connectionmanager
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Storage for ConnectionManager state that should survive a restart
+//
+// Methods are only called from the ConnectionManager's goroutine (or
+// from SetStore()), never concurrently.
+type Store interface {
+	// Save or replace an encoded scheduled message
+	SaveScheduled(id string, data []byte) error
+
+	// Remove a scheduled message; removing an unknown ID is not an
+	// error
+	DeleteScheduled(id string) error
+
+	// Return all saved scheduled messages, keyed by ID
+	LoadScheduled() (map[string][]byte, error)
+}
+
+// A Store that keeps one file per item under a directory
+type FileStore struct {
+	dir string
+}
+
+// Create a FileStore rooted at dir, creating it if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	fs := &FileStore{dir: dir}
+
+	if err := os.MkdirAll(fs.scheduledDir(), 0700); err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+// Directory holding scheduled messages
+func (fs *FileStore) scheduledDir() string {
+	return filepath.Join(fs.dir, "scheduled")
+}
+
+// Save or replace an encoded scheduled message
+//
+// The file is written under a temporary name and renamed into place so
+// a crash never leaves a partial item behind.
+func (fs *FileStore) SaveScheduled(id string, data []byte) error {
+	name := filepath.Join(fs.scheduledDir(), id)
+	tmp := name + ".tmp"
+
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+// Remove a scheduled message
+func (fs *FileStore) DeleteScheduled(id string) error {
+	err := os.Remove(filepath.Join(fs.scheduledDir(), id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Return all saved scheduled messages
+func (fs *FileStore) LoadScheduled() (map[string][]byte, error) {
+	entries, err := os.ReadDir(fs.scheduledDir())
+	if err != nil {
+		return nil, err
+	}
+
+	r := make(map[string][]byte)
+
+	for _, fi := range entries {
+		if fi.IsDir() || filepath.Ext(fi.Name()) == ".tmp" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(fs.scheduledDir(), fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		r[fi.Name()] = data
+	}
+
+	return r, nil
+}
@@ -0,0 +1,622 @@
+// TCP transport between cluster nodes
+
+package connectionmanager
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Record types on a TCPTransport connection
+const (
+	tcpChallenge byte = 'C' // nonce
+	tcpHello     byte = 'H' // node name, incarnation, MAC of the nonce
+	tcpData      byte = 'D' // sequence number, frame
+	tcpAck       byte = 'A' // highest sequence number received
+)
+
+// Size of the nonce a listener challenges each connection with
+const tcpNonceSize = 16
+
+// How long either side waits for the other's part of the handshake
+const tcpHandshakeTimeout = 5 * time.Second
+
+// How long to wait between attempts to reach a peer
+const tcpRedialDelay = 500 * time.Millisecond
+
+// How long RemovePeer waits for a peer to acknowledge queued frames
+const tcpRemoveTimeout = 30 * time.Second
+
+// Largest frame a TCPTransport will accept
+const tcpMaxFrame = 16 << 20
+
+// Most bytes of unacknowledged frames queued for one peer; Send fails
+// beyond this
+const tcpMaxPending = 64 << 20
+
+// Transport over TCP (implements Transport)
+//
+// Each node dials each of its peers and sends frames on that
+// connection; the peer acknowledges them on the same connection. Frames
+// stay queued until acknowledged, and are resent after a reconnect, so
+// a peer that restarts or drops off the network briefly misses nothing.
+// Receivers discard the duplicates this causes. A peer that stays away
+// long enough to build up tcpMaxPending bytes of frames gets no more
+// until it catches up.
+//
+// The listening side challenges each connection with a nonce, which the
+// dialing node answers with an HMAC keyed with the shared secret, so
+// only nodes that know the secret can send frames. See SetSecret.
+type TCPTransport struct {
+	name string
+
+	// key for the handshake MAC
+	secret []byte
+
+	// distinguishes this run of the node from earlier ones, so peers
+	// know to reset their duplicate tracking
+	incarnation uint64
+
+	listener net.Listener
+	inbox    *frameQueue
+
+	lock sync.Mutex
+
+	// outgoing peers, by name
+	peers map[string]*tcpPeer
+
+	// highest sequence number received from each node
+	received map[string]tcpReceived
+
+	// open connections, so Close can interrupt them
+	conns map[net.Conn]bool
+
+	closed bool
+}
+
+// Receive state for one sending node
+type tcpReceived struct {
+	incarnation uint64
+	seq         uint64
+}
+
+// A frame waiting for acknowledgment
+type tcpPending struct {
+	seq  uint64
+	data []byte
+}
+
+// Sending side of a connection to a peer
+type tcpPeer struct {
+	transport *TCPTransport
+	name      string
+	addr      string
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	// unacknowledged frames, oldest first
+	pending []tcpPending
+
+	// total size of the frames in pending
+	pendingBytes int
+
+	// how many of pending have been written on the current connection
+	written int
+
+	nextSeq uint64
+
+	// set by RemovePeer: finish once pending is empty
+	removing bool
+
+	// set when the peer should stop immediately
+	closed bool
+
+	// closed when the peer's goroutine exits
+	done chan struct{}
+}
+
+// Create a TCPTransport for node name, listening on addr
+func NewTCPTransport(name string, addr string) (*TCPTransport, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TCPTransport{
+		name:        name,
+		incarnation: uint64(time.Now().UnixNano()),
+		listener:    listener,
+		inbox:       newFrameQueue(),
+		peers:       make(map[string]*tcpPeer),
+		received:    make(map[string]tcpReceived),
+		conns:       make(map[net.Conn]bool),
+	}
+
+	go t.acceptLoop()
+
+	return t, nil
+}
+
+// Set the secret nodes share, which every node in the cluster must use
+//
+// Connections from nodes that answer the handshake with a different
+// secret are dropped. Without a secret, any node that can reach the
+// listening address is accepted, so set one before adding peers in any
+// network that isn't trusted.
+func (t *TCPTransport) SetSecret(secret []byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.secret = append([]byte(nil), secret...)
+}
+
+// The address the transport is listening on
+func (t *TCPTransport) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// This node's name
+func (t *TCPTransport) Local() string {
+	return t.name
+}
+
+// Queue a frame for a peer
+//
+// Fails if the peer already has tcpMaxPending bytes of frames waiting.
+func (t *TCPTransport) Send(node string, data []byte) error {
+	t.lock.Lock()
+	p, ok := t.peers[node]
+	t.lock.Unlock()
+
+	if !ok {
+		return errors.New(fmt.Sprintf("TCPTransport: unknown peer: %s", node))
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.removing || p.closed {
+		return errors.New(fmt.Sprintf("TCPTransport: peer is leaving: %s", node))
+	}
+
+	if p.pendingBytes+len(data) > tcpMaxPending {
+		return errors.New(fmt.Sprintf("TCPTransport: too much queued for peer: %s", node))
+	}
+
+	p.nextSeq++
+	p.pending = append(p.pending, tcpPending{
+		seq:  p.nextSeq,
+		data: append([]byte(nil), data...),
+	})
+	p.pendingBytes += len(data)
+	p.cond.Broadcast()
+
+	return nil
+}
+
+// Frames from peers
+func (t *TCPTransport) Receive() <-chan Frame {
+	return t.inbox.out
+}
+
+// Start sending to a node listening at addr
+func (t *TCPTransport) AddPeer(node string, addr string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return errors.New("TCPTransport: closed")
+	}
+
+	if _, present := t.peers[node]; present {
+		return errors.New(fmt.Sprintf("TCPTransport: peer already exists: %s", node))
+	}
+
+	p := &tcpPeer{
+		transport: t,
+		name:      node,
+		addr:      addr,
+		done:      make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.lock)
+
+	t.peers[node] = p
+
+	go p.run()
+
+	return nil
+}
+
+// Stop sending to a node once everything queued for it is acknowledged
+//
+// Blocks until then, or until the transport is closed. If the peer
+// can't be reached for tcpRemoveTimeout, its frames are abandoned.
+func (t *TCPTransport) RemovePeer(node string) error {
+	t.lock.Lock()
+	p, ok := t.peers[node]
+	t.lock.Unlock()
+
+	if !ok {
+		return errors.New(fmt.Sprintf("TCPTransport: unknown peer: %s", node))
+	}
+
+	p.lock.Lock()
+	p.removing = true
+	p.cond.Broadcast()
+	p.lock.Unlock()
+
+	select {
+	case <-p.done:
+	case <-time.After(tcpRemoveTimeout):
+		p.lock.Lock()
+		p.closed = true
+		p.cond.Broadcast()
+		p.lock.Unlock()
+
+		<-p.done
+	}
+
+	t.lock.Lock()
+	if t.peers[node] == p {
+		delete(t.peers, node)
+	}
+	t.lock.Unlock()
+
+	return nil
+}
+
+// Names of the current peers
+func (t *TCPTransport) Peers() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	r := make([]string, 0, len(t.peers))
+	for node := range t.peers {
+		r = append(r, node)
+	}
+	sort.Strings(r)
+
+	return r
+}
+
+// Shut the transport down, abandoning unacknowledged frames
+func (t *TCPTransport) Close() error {
+	t.lock.Lock()
+
+	if t.closed {
+		t.lock.Unlock()
+		return nil
+	}
+
+	t.closed = true
+
+	for _, p := range t.peers {
+		p.lock.Lock()
+		p.closed = true
+		p.cond.Broadcast()
+		p.lock.Unlock()
+	}
+
+	for conn := range t.conns {
+		conn.Close()
+	}
+
+	t.lock.Unlock()
+
+	err := t.listener.Close()
+	t.inbox.close()
+
+	return err
+}
+
+// Track an open connection; returns false if the transport is closed
+func (t *TCPTransport) addConn(conn net.Conn) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		conn.Close()
+		return false
+	}
+
+	t.conns[conn] = true
+
+	return true
+}
+
+// Stop tracking and close a connection
+func (t *TCPTransport) removeConn(conn net.Conn) {
+	t.lock.Lock()
+	delete(t.conns, conn)
+	t.lock.Unlock()
+
+	conn.Close()
+}
+
+// Accept connections from peers (runs as a goroutine)
+func (t *TCPTransport) acceptLoop() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		if t.addConn(conn) {
+			go t.serveConn(conn)
+		}
+	}
+}
+
+// Receive frames on an accepted connection (runs as a goroutine)
+func (t *TCPTransport) serveConn(conn net.Conn) {
+	defer t.removeConn(conn)
+
+	nonce := make([]byte, tcpNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return
+	}
+
+	if _, err := conn.Write(append([]byte{tcpChallenge}, nonce...)); err != nil {
+		return
+	}
+
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(tcpHandshakeTimeout))
+
+	kind, err := r.ReadByte()
+	if err != nil || kind != tcpHello {
+		return
+	}
+
+	from, err := tcpReadString(r)
+	if err != nil {
+		return
+	}
+
+	incarnation, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+
+	mac, err := tcpReadBytes(r)
+	if err != nil || !hmac.Equal(mac, t.handshakeMAC(nonce, from, incarnation)) {
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	t.lock.Lock()
+	if t.received[from].incarnation != incarnation {
+		t.received[from] = tcpReceived{incarnation: incarnation}
+	}
+	t.lock.Unlock()
+
+	for {
+		kind, err := r.ReadByte()
+		if err != nil || kind != tcpData {
+			return
+		}
+
+		seq, err := binary.ReadUvarint(r)
+		if err != nil {
+			return
+		}
+
+		data, err := tcpReadBytes(r)
+		if err != nil {
+			return
+		}
+
+		// skip frames we've already seen (resent after a reconnect)
+		t.lock.Lock()
+		rcv := t.received[from]
+		fresh := rcv.incarnation == incarnation && seq > rcv.seq
+		if fresh {
+			rcv.seq = seq
+			t.received[from] = rcv
+		}
+		t.lock.Unlock()
+
+		if fresh {
+			t.inbox.push(Frame{From: from, Data: data})
+		}
+
+		ack := binary.AppendUvarint([]byte{tcpAck}, seq)
+		if _, err := conn.Write(ack); err != nil {
+			return
+		}
+	}
+}
+
+// Compute a dialing node's answer to a listener's challenge
+func (t *TCPTransport) handshakeMAC(nonce []byte, name string, incarnation uint64) []byte {
+	t.lock.Lock()
+	mac := hmac.New(sha256.New, t.secret)
+	t.lock.Unlock()
+
+	mac.Write(nonce)
+	mac.Write(tcpAppendBytes(nil, []byte(name)))
+	mac.Write(binary.AppendUvarint(nil, incarnation))
+
+	return mac.Sum(nil)
+}
+
+// Read a length-prefixed byte string
+func tcpReadBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > tcpMaxFrame {
+		return nil, errors.New(fmt.Sprintf("TCPTransport: frame too large: %d bytes", n))
+	}
+
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+
+	return data, err
+}
+
+// Read a length-prefixed string
+func tcpReadString(r *bufio.Reader) (string, error) {
+	data, err := tcpReadBytes(r)
+	return string(data), err
+}
+
+// Append a length-prefixed byte string
+func tcpAppendBytes(buf []byte, data []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// True if the peer's goroutine should exit
+//
+// Must be called with p.lock held.
+func (p *tcpPeer) finished() bool {
+	return p.closed || (p.removing && len(p.pending) == 0)
+}
+
+// Connect to the peer and send frames, reconnecting as needed (runs as
+// a goroutine)
+func (p *tcpPeer) run() {
+	defer close(p.done)
+
+	t := p.transport
+
+	for {
+		p.lock.Lock()
+		if p.finished() {
+			p.lock.Unlock()
+			return
+		}
+		p.written = 0
+		p.lock.Unlock()
+
+		conn, err := net.DialTimeout("tcp", p.addr, tcpRedialDelay*4)
+		if err == nil && t.addConn(conn) {
+			p.serve(conn)
+			t.removeConn(conn)
+		}
+
+		// wait a bit before trying again, unless we're done
+		p.lock.Lock()
+		if !p.finished() {
+			timer := time.AfterFunc(tcpRedialDelay, func() {
+				p.lock.Lock()
+				p.cond.Broadcast()
+				p.lock.Unlock()
+			})
+			p.cond.Wait()
+			timer.Stop()
+		}
+		p.lock.Unlock()
+	}
+}
+
+// Send frames on a connection until it fails or the peer is finished
+func (p *tcpPeer) serve(conn net.Conn) {
+	t := p.transport
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(tcpHandshakeTimeout))
+
+	kind, err := r.ReadByte()
+	if err != nil || kind != tcpChallenge {
+		return
+	}
+
+	nonce := make([]byte, tcpNonceSize)
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	hello := []byte{tcpHello}
+	hello = tcpAppendBytes(hello, []byte(t.name))
+	hello = binary.AppendUvarint(hello, t.incarnation)
+	hello = tcpAppendBytes(hello, t.handshakeMAC(nonce, t.name, t.incarnation))
+
+	if _, err := conn.Write(hello); err != nil {
+		return
+	}
+
+	// read acks, waking the writer when the connection fails
+	failed := false
+	go func() {
+		for {
+			kind, err := r.ReadByte()
+			var seq uint64
+			if err == nil && kind == tcpAck {
+				seq, err = binary.ReadUvarint(r)
+			} else if err == nil {
+				err = errors.New("bad record")
+			}
+
+			p.lock.Lock()
+
+			if err != nil {
+				failed = true
+				p.cond.Broadcast()
+				p.lock.Unlock()
+				conn.Close()
+				return
+			}
+
+			// drop everything acknowledged
+			n := 0
+			for n < len(p.pending) && p.pending[n].seq <= seq {
+				p.pendingBytes -= len(p.pending[n].data)
+				n++
+			}
+			p.pending = p.pending[n:]
+			p.written -= n
+			if p.written < 0 {
+				p.written = 0
+			}
+
+			p.cond.Broadcast()
+			p.lock.Unlock()
+		}
+	}()
+
+	for {
+		p.lock.Lock()
+		for !failed && !p.finished() && p.written == len(p.pending) {
+			p.cond.Wait()
+		}
+
+		if failed || p.finished() {
+			p.lock.Unlock()
+			conn.Close()
+			return
+		}
+
+		var buf []byte
+		for _, f := range p.pending[p.written:] {
+			buf = append(buf, tcpData)
+			buf = binary.AppendUvarint(buf, f.seq)
+			buf = tcpAppendBytes(buf, f.data)
+		}
+		p.written = len(p.pending)
+		p.lock.Unlock()
+
+		if _, err := conn.Write(buf); err != nil {
+			conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Signed connection tokens
+
+package connectionmanager
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Marks the start of a signed token, so it can be told apart from a
+// plain connection ID
+const tokenPrefix = "cmt1."
+
+// How long issued tokens last, unless told otherwise
+const defaultTokenTTL = 24 * time.Hour
+
+// What a signed token says
+type tokenClaims struct {
+	// ID of the key that signed it
+	KeyId string `json:"kid"`
+
+	// the connection ID
+	Id string `json:"id"`
+
+	// issue and expiry times, in Unix seconds
+	Issued  int64 `json:"iat"`
+	Expires int64 `json:"exp"`
+}
+
+// Returned in the Err field of the response to a request whose token
+// is expired, forged or malformed
+type TokenError struct {
+	// the request's type
+	Type MessageType
+
+	// what was wrong with the token
+	Reason string
+}
+
+func (e *TokenError) Error() string {
+	return fmt.Sprintf("bad token (message type %d): %s", e.Type, e.Reason)
+}
+
+// Issues and checks connection tokens: connection IDs signed with
+// HMAC-SHA256, along with when they were issued and when they expire
+//
+// Any manager holding the same keys can check a token without knowing
+// anything about the connection, so tokens survive restarts and work on
+// every node of a cluster. Keys are named, and several can be active at
+// once, so they can be rotated: add the new key everywhere, make it the
+// signing key, then remove the old one once its tokens have expired.
+// Methods are safe for concurrent use.
+type TokenSigner struct {
+	lock sync.RWMutex
+
+	// active keys by key ID
+	keys map[string][]byte
+
+	// ID of the key new tokens are signed with
+	signingKey string
+
+	// how long issued tokens last
+	ttl time.Duration
+}
+
+// Create a TokenSigner that signs with key, named keyId
+func NewTokenSigner(keyId string, key []byte) *TokenSigner {
+	return &TokenSigner{
+		keys:       map[string][]byte{keyId: key},
+		signingKey: keyId,
+		ttl:        defaultTokenTTL,
+	}
+}
+
+// Set how long issued tokens last (0 means 24 hours)
+func (s *TokenSigner) SetTTL(ttl time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if ttl <= 0 {
+		ttl = defaultTokenTTL
+	}
+
+	s.ttl = ttl
+}
+
+// Accept tokens signed with key, named keyId
+func (s *TokenSigner) AddKey(keyId string, key []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.keys[keyId] = key
+}
+
+// Sign new tokens with the key named keyId, which must have been added
+func (s *TokenSigner) SetSigningKey(keyId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.keys[keyId]; !ok {
+		return errors.New(fmt.Sprintf("SetSigningKey: unknown key id: %s", keyId))
+	}
+
+	s.signingKey = keyId
+
+	return nil
+}
+
+// Stop accepting tokens signed with the key named keyId
+//
+// The signing key can't be removed.
+func (s *TokenSigner) RemoveKey(keyId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if keyId == s.signingKey {
+		return errors.New(fmt.Sprintf("RemoveKey: %s is the signing key", keyId))
+	}
+
+	delete(s.keys, keyId)
+
+	return nil
+}
+
+// Compute the signature of a token's claims
+func tokenSignature(key []byte, claims []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(claims)
+
+	return mac.Sum(nil)
+}
+
+// Issue a token for a connection ID, valid from now
+func (s *TokenSigner) Issue(id string, now time.Time) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	claims, _ := json.Marshal(&tokenClaims{
+		KeyId:   s.signingKey,
+		Id:      id,
+		Issued:  now.Unix(),
+		Expires: now.Add(s.ttl).Unix(),
+	})
+
+	sig := tokenSignature(s.keys[s.signingKey], claims)
+
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(claims) + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// Check a token, returning the connection ID it was issued for
+//
+// Returns an error giving the reason if the token is malformed, isn't
+// signed by an active key, or has expired.
+func (s *TokenSigner) Verify(token string, now time.Time) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(token, tokenPrefix), ".")
+	if !strings.HasPrefix(token, tokenPrefix) || len(parts) != 2 {
+		return "", errors.New("malformed token")
+	}
+
+	claimsData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errors.New("malformed token")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("malformed token")
+	}
+
+	var claims tokenClaims
+	if err := json.Unmarshal(claimsData, &claims); err != nil {
+		return "", errors.New("malformed token")
+	}
+
+	s.lock.RLock()
+	key, ok := s.keys[claims.KeyId]
+	s.lock.RUnlock()
+
+	if !ok {
+		return "", errors.New(fmt.Sprintf("unknown key id: %s", claims.KeyId))
+	}
+
+	if !hmac.Equal(sig, tokenSignature(key, claimsData)) {
+		return "", errors.New("bad signature")
+	}
+
+	if now.Unix() >= claims.Expires {
+		return "", errors.New(fmt.Sprintf("expired at %v", time.Unix(claims.Expires, 0)))
+	}
+
+	return claims.Id, nil
+}
+
+// Require polls to present signed tokens, issued by s, in place of
+// connection IDs
+//
+// Each ConnectResponse carries a Token for the connection. A
+// PollRequest's Id must be a valid token, and other requests may give a
+// token as their Id; either way it's replaced by the connection ID it
+// was issued for before the request is handled. Requests with expired
+// or forged tokens are refused with a *TokenError. Must be called
+// before SetActive(true).
+func (cm *Manager[T]) SetTokenSigner(s *TokenSigner) {
+	cm.tokenSigner = s
+}
+
+// Swap the token in a request's Id for the connection ID it stands for
+//
+// Returns a *TokenError if the token doesn't check out, or is missing
+// from a PollRequest. The message inside a ScheduleRequest is sent
+// later in its own name, so its token is swapped too, in a copy.
+func (cm *Manager[T]) checkToken(m *TypedMessage[T], now time.Time) error {
+	if cm.tokenSigner == nil || m.Type < 0 {
+		return nil
+	}
+
+	if sm, ok := m.General.(*TypedMessage[T]); ok && m.Type == ScheduleRequest {
+		scheduled := *sm
+		if err := cm.checkToken(&scheduled, now); err != nil {
+			return err
+		}
+		m.General = &scheduled
+	}
+
+	if !strings.HasPrefix(m.Id, tokenPrefix) {
+		if m.Type == PollRequest {
+			return &TokenError{Type: m.Type, Reason: "polls need a token"}
+		}
+
+		return nil
+	}
+
+	id, err := cm.tokenSigner.Verify(m.Id, now)
+	if err != nil {
+		return &TokenError{Type: m.Type, Reason: err.Error()}
+	}
+
+	m.Id = id
+
+	return nil
+}
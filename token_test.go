@@ -0,0 +1,142 @@
+package connectionmanager
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenSigner(t *testing.T) {
+	now := time.Now()
+
+	s := NewTokenSigner("k1", []byte("first secret"))
+	s.SetTTL(time.Minute)
+
+	token := s.Issue("alpha", now)
+
+	if id, err := s.Verify(token, now); err != nil || id != "alpha" {
+		t.Errorf("expected alpha, got %q %v", id, err)
+	}
+
+	if _, err := s.Verify(token, now.Add(2*time.Minute)); err == nil {
+		t.Errorf("expected expired token to be rejected")
+	}
+
+	// another node with the same key agrees; one with another doesn't
+	if id, err := NewTokenSigner("k1", []byte("first secret")).Verify(token, now); err != nil || id != "alpha" {
+		t.Errorf("expected alpha on another node, got %q %v", id, err)
+	}
+
+	if _, err := NewTokenSigner("k1", []byte("wrong secret")).Verify(token, now); err == nil {
+		t.Errorf("expected a token signed with another key to be rejected")
+	}
+
+	// changing the claims breaks the signature
+	parts := strings.Split(token, ".")
+	forged := s.Issue("beta", now)
+	forged = strings.Join([]string{parts[0], strings.Split(forged, ".")[1], parts[2]}, ".")
+
+	if _, err := s.Verify(forged, now); err == nil {
+		t.Errorf("expected forged token to be rejected")
+	}
+
+	for _, bad := range []string{"", "alpha", "cmt1.", "cmt1.x.y", "cmt1.a.b.c"} {
+		if _, err := s.Verify(bad, now); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+
+	// rotation: both keys work while they're active
+	s.AddKey("k2", []byte("second secret"))
+	if err := s.SetSigningKey("k2"); err != nil {
+		t.Fatalf("SetSigningKey: %v", err)
+	}
+
+	rotated := s.Issue("gamma", now)
+
+	for _, tok := range []string{token, rotated} {
+		if _, err := s.Verify(tok, now); err != nil {
+			t.Errorf("expected token to be valid during rotation: %v", err)
+		}
+	}
+
+	if err := s.RemoveKey("k2"); err == nil {
+		t.Errorf("expected error removing the signing key")
+	}
+
+	s.RemoveKey("k1")
+
+	if _, err := s.Verify(token, now); err == nil {
+		t.Errorf("expected token signed with a removed key to be rejected")
+	}
+
+	if id, err := s.Verify(rotated, now); err != nil || id != "gamma" {
+		t.Errorf("expected gamma, got %q %v", id, err)
+	}
+}
+
+func TestSignedPolls(t *testing.T) {
+	cm := New()
+	cm.SetTokenSigner(NewTokenSigner("k1", []byte("secret")))
+	cm.SetActive(true)
+	defer cm.SetActive(false)
+
+	resp := cm.SendMessage(&Message{Type: ConnectRequest, Id: "alpha"})
+	if resp.Err != nil || resp.Token == "" {
+		t.Fatalf("ConnectRequest: expected a token, got %q %v", resp.Token, resp.Err)
+	}
+
+	token := resp.Token
+
+	// the bare ID won't do for polling
+	var te *TokenError
+	if err := cm.SendMessage(&Message{Type: PollRequest, Id: "alpha"}).Err; !errors.As(err, &te) {
+		t.Errorf("expected TokenError polling without a token, got %v", err)
+	}
+
+	if err := cm.SendMessage(&Message{Type: PollRequest, Id: token + "x"}).Err; !errors.As(err, &te) {
+		t.Errorf("expected TokenError polling with a forged token, got %v", err)
+	}
+
+	// senders can give a token too, and are known by the ID in it
+	broadcastTest(t, cm, &Message{Id: token}, "signed")
+
+	batch := pollTest(t, cm, &Message{Id: token})
+	if len(batch) != 1 || batch[0].Sender() != "alpha" {
+		t.Errorf("expected a broadcast from alpha, got %v", batch)
+	}
+
+	// so can scheduled messages, which go out under the ID, not the
+	// token
+	scheduled := &Message{Type: BroadcastRequest, Id: token, Payload: &MessagePayload{"text": "later"}}
+	scheduleTest(t, cm, time.Now(), scheduled)
+
+	batch = pollTest(t, cm, &Message{Id: token})
+	if len(batch) != 1 || batch[0].Sender() != "alpha" {
+		t.Errorf("expected a scheduled broadcast from alpha, got %v", batch)
+	}
+
+	if scheduled.Id != token {
+		t.Errorf("the caller's scheduled message was changed: %v", scheduled.Id)
+	}
+
+	err := cm.SendMessage(&Message{
+		Type:    ScheduleRequest,
+		At:      time.Now(),
+		General: &Message{Type: BroadcastRequest, Id: token + "x"},
+	}).Err
+	if !errors.As(err, &te) {
+		t.Errorf("expected TokenError scheduling with a forged token, got %v", err)
+	}
+
+	server := httptest.NewServer(NewLongPollHandler(cm))
+	defer server.Close()
+
+	var status map[string]string
+	if code := longPollTest(t, server, "id=alpha", &status); code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d %v", code, status)
+	}
+}
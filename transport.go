@@ -0,0 +1,236 @@
+// Transports between cluster nodes
+
+package connectionmanager
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A frame received from another cluster node
+type Frame struct {
+	// name of the sending node
+	From string
+
+	// frame contents
+	Data []byte
+}
+
+// Carries frames between the nodes of a cluster
+//
+// Send must not block on the network: frames to a peer are queued and
+// delivered in order, and are kept (and retried) until the peer has
+// them or is removed. Methods must be safe for concurrent use.
+type Transport interface {
+	// This node's name
+	Local() string
+
+	// Queue a frame for a peer
+	Send(node string, data []byte) error
+
+	// Frames from peers; closed when the transport is closed
+	Receive() <-chan Frame
+
+	// Start sending to a node at addr (the meaning of addr depends on
+	// the transport)
+	AddPeer(node string, addr string) error
+
+	// Stop sending to a node once the frames already queued for it
+	// have been delivered
+	RemovePeer(node string) error
+
+	// Names of the current peers
+	Peers() []string
+
+	// Shut the transport down
+	Close() error
+}
+
+// Frames waiting to be handed to a receiver, so that senders never
+// block on a slow one
+type frameQueue struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	frames []Frame
+	closed bool
+	out    chan Frame
+}
+
+// Create a frameQueue and start its delivery goroutine
+func newFrameQueue() *frameQueue {
+	q := &frameQueue{out: make(chan Frame)}
+	q.cond = sync.NewCond(&q.lock)
+
+	go q.run()
+
+	return q
+}
+
+// Queue a frame for the receiver
+func (q *frameQueue) push(f Frame) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if !q.closed {
+		q.frames = append(q.frames, f)
+		q.cond.Signal()
+	}
+}
+
+// Stop delivering; out is closed once the goroutine notices
+func (q *frameQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.cond.Signal()
+}
+
+// Move frames to the out channel (runs as a goroutine)
+func (q *frameQueue) run() {
+	defer close(q.out)
+
+	for {
+		q.lock.Lock()
+		for len(q.frames) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+
+		if q.closed {
+			q.lock.Unlock()
+			return
+		}
+
+		f := q.frames[0]
+		q.frames[0] = Frame{}
+		q.frames = q.frames[1:]
+		q.lock.Unlock()
+
+		q.out <- f
+	}
+}
+
+// An in-process network of MemoryTransports, for tests and
+// single-process clusters
+type MemoryNetwork struct {
+	lock  sync.Mutex
+	nodes map[string]*MemoryTransport
+}
+
+// Transport attached to a MemoryNetwork (implements Transport)
+type MemoryTransport struct {
+	network *MemoryNetwork
+	name    string
+	inbox   *frameQueue
+
+	lock  sync.Mutex
+	peers map[string]bool
+}
+
+// Create an empty MemoryNetwork
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{nodes: make(map[string]*MemoryTransport)}
+}
+
+// Attach a new node to the network
+func (n *MemoryNetwork) Transport(name string) (*MemoryTransport, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if _, present := n.nodes[name]; present {
+		return nil, errors.New(fmt.Sprintf("MemoryNetwork: node already exists: %s", name))
+	}
+
+	t := &MemoryTransport{
+		network: n,
+		name:    name,
+		inbox:   newFrameQueue(),
+		peers:   make(map[string]bool),
+	}
+
+	n.nodes[name] = t
+
+	return t, nil
+}
+
+// This node's name
+func (t *MemoryTransport) Local() string {
+	return t.name
+}
+
+// Deliver a frame to a peer
+func (t *MemoryTransport) Send(node string, data []byte) error {
+	t.lock.Lock()
+	isPeer := t.peers[node]
+	t.lock.Unlock()
+
+	if !isPeer {
+		return errors.New(fmt.Sprintf("MemoryTransport: unknown peer: %s", node))
+	}
+
+	t.network.lock.Lock()
+	dest, ok := t.network.nodes[node]
+	t.network.lock.Unlock()
+
+	if !ok {
+		return errors.New(fmt.Sprintf("MemoryTransport: node not on network: %s", node))
+	}
+
+	dest.inbox.push(Frame{From: t.name, Data: append([]byte(nil), data...)})
+
+	return nil
+}
+
+// Frames from peers
+func (t *MemoryTransport) Receive() <-chan Frame {
+	return t.inbox.out
+}
+
+// Start sending to a node; addr is ignored
+func (t *MemoryTransport) AddPeer(node string, addr string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.peers[node] = true
+
+	return nil
+}
+
+// Stop sending to a node
+//
+// Sends are delivered immediately, so nothing can be pending.
+func (t *MemoryTransport) RemovePeer(node string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.peers, node)
+
+	return nil
+}
+
+// Names of the current peers
+func (t *MemoryTransport) Peers() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	r := make([]string, 0, len(t.peers))
+	for node := range t.peers {
+		r = append(r, node)
+	}
+	sort.Strings(r)
+
+	return r
+}
+
+// Detach from the network
+func (t *MemoryTransport) Close() error {
+	t.network.lock.Lock()
+	delete(t.network.nodes, t.name)
+	t.network.lock.Unlock()
+
+	t.inbox.close()
+
+	return nil
+}
@@ -0,0 +1,361 @@
+// WebSocket protocol (RFC 6455), server side
+
+package connectionmanager
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Frame opcodes
+const (
+	wsContinuation byte = 0x0
+	wsText         byte = 0x1
+	wsBinary       byte = 0x2
+	wsClose        byte = 0x8
+	wsPing         byte = 0x9
+	wsPong         byte = 0xa
+)
+
+// Close status codes
+const (
+	wsCloseNormal        = 1000
+	wsCloseGoingAway     = 1001
+	wsCloseProtocolError = 1002
+	wsCloseInvalidData   = 1007
+	wsCloseTooBig        = 1009
+)
+
+// Appended to the client's key to make Sec-WebSocket-Accept
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Largest message a wsConn will accept, across all its fragments
+const wsMaxMessage = 16 << 20
+
+// A WebSocket that's closed, as seen by the reader
+var errWSClosed = errors.New("websocket: closed")
+
+// The server end of a WebSocket
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	writeLock sync.Mutex
+
+	// set once a close frame has been sent
+	closeSent bool
+}
+
+// True if a comma-separated header list contains token
+func wsHeaderHas(h http.Header, name string, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Return the subprotocols a handshake offers, best first
+func wsProtocols(h http.Header) []string {
+	var r []string
+
+	for _, v := range h.Values("Sec-WebSocket-Protocol") {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				r = append(r, t)
+			}
+		}
+	}
+
+	return r
+}
+
+// True if the request comes from a page on the same host, or from
+// something that isn't a browser (no Origin)
+func wsSameOrigin(rq *http.Request) bool {
+	origin := rq.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, rq.Host)
+}
+
+// Compute Sec-WebSocket-Accept for a Sec-WebSocket-Key
+func wsAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsAcceptGUID))
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Check an opening handshake and switch the connection over to the
+// WebSocket protocol, speaking subprotocol protocol if it's set
+//
+// On failure an HTTP error has been sent and an error is returned.
+func wsUpgrade(rw http.ResponseWriter, rq *http.Request, protocol string) (*wsConn, error) {
+	fail := func(status int, msg string) (*wsConn, error) {
+		http.Error(rw, msg, status)
+		return nil, errors.New("websocket: " + msg)
+	}
+
+	if rq.Method != http.MethodGet {
+		return fail(http.StatusMethodNotAllowed, "method not allowed")
+	}
+
+	if !wsHeaderHas(rq.Header, "Connection", "upgrade") || !wsHeaderHas(rq.Header, "Upgrade", "websocket") {
+		return fail(http.StatusBadRequest, "not a websocket handshake")
+	}
+
+	if rq.Header.Get("Sec-WebSocket-Version") != "13" {
+		rw.Header().Set("Sec-WebSocket-Version", "13")
+		return fail(http.StatusUpgradeRequired, "unsupported websocket version")
+	}
+
+	key := rq.Header.Get("Sec-WebSocket-Key")
+	if k, err := base64.StdEncoding.DecodeString(key); err != nil || len(k) != 16 {
+		return fail(http.StatusBadRequest, "bad Sec-WebSocket-Key")
+	}
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		return fail(http.StatusInternalServerError, "connection can't be taken over")
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return fail(http.StatusInternalServerError, err.Error())
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n"
+
+	if protocol != "" {
+		resp += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+
+	resp += "\r\n"
+
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{conn: conn, r: brw.Reader}, nil
+}
+
+// Write a single unfragmented frame (servers don't mask)
+func (ws *wsConn) writeFrame(opcode byte, data []byte) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+
+	if ws.closeSent {
+		return errWSClosed
+	}
+
+	if opcode == wsClose {
+		ws.closeSent = true
+	}
+
+	buf := make([]byte, 0, len(data)+10)
+	buf = append(buf, 0x80|opcode)
+
+	switch n := len(data); {
+	case n <= 125:
+		buf = append(buf, byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	buf = append(buf, data...)
+
+	_, err := ws.conn.Write(buf)
+
+	return err
+}
+
+// Send a text message
+func (ws *wsConn) writeText(data []byte) error {
+	return ws.writeFrame(wsText, data)
+}
+
+// Start the closing handshake with a status code
+func (ws *wsConn) close(code int, reason string) error {
+	data := binary.BigEndian.AppendUint16(nil, uint16(code))
+
+	return ws.writeFrame(wsClose, append(data, reason...))
+}
+
+// Read a frame header and payload
+func (ws *wsConn) readFrame() (fin bool, opcode byte, data []byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(ws.r, h[:]); err != nil {
+		return
+	}
+
+	fin = h[0]&0x80 != 0
+	opcode = h[0] & 0x0f
+
+	if h[0]&0x70 != 0 {
+		err = wsProtocolError(wsCloseProtocolError, "reserved bits set")
+		return
+	}
+
+	if h[1]&0x80 == 0 {
+		err = wsProtocolError(wsCloseProtocolError, "client frame not masked")
+		return
+	}
+
+	n := uint64(h[1] & 0x7f)
+
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.r, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.r, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if opcode >= wsClose && (n > 125 || !fin) {
+		err = wsProtocolError(wsCloseProtocolError, "bad control frame")
+		return
+	}
+
+	if n > wsMaxMessage {
+		err = wsProtocolError(wsCloseTooBig, "message too big")
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.r, mask[:]); err != nil {
+		return
+	}
+
+	data = make([]byte, n)
+	if _, err = io.ReadFull(ws.r, data); err != nil {
+		return
+	}
+
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+
+	return
+}
+
+// A violation of the protocol by the client, and the status to close
+// with
+type wsError struct {
+	code   int
+	reason string
+}
+
+func (e *wsError) Error() string {
+	return fmt.Sprintf("websocket: %s", e.reason)
+}
+
+// Make a wsError
+func wsProtocolError(code int, reason string) error {
+	return &wsError{code: code, reason: reason}
+}
+
+// Read the next text or binary message, reassembling fragments and
+// answering control frames along the way
+//
+// Returns errWSClosed once the client has closed the connection.
+// Protocol errors are returned as *wsError, for the caller to close
+// with.
+func (ws *wsConn) readMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	fragmented := false
+
+	for {
+		fin, op, data, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case wsPing:
+			if err := ws.writeFrame(wsPong, data); err != nil {
+				return 0, nil, err
+			}
+			continue
+
+		case wsPong:
+			continue
+
+		case wsClose:
+			// echo the status back, completing the closing handshake
+			if len(data) >= 2 {
+				data = data[:2]
+			}
+			ws.writeFrame(wsClose, data)
+			return 0, nil, errWSClosed
+
+		case wsText, wsBinary:
+			if fragmented {
+				return 0, nil, wsProtocolError(wsCloseProtocolError, "expected continuation frame")
+			}
+			opcode = op
+			message = data
+
+		case wsContinuation:
+			if !fragmented {
+				return 0, nil, wsProtocolError(wsCloseProtocolError, "unexpected continuation frame")
+			}
+			if len(message)+len(data) > wsMaxMessage {
+				return 0, nil, wsProtocolError(wsCloseTooBig, "message too big")
+			}
+			message = append(message, data...)
+
+		default:
+			return 0, nil, wsProtocolError(wsCloseProtocolError, fmt.Sprintf("unknown opcode %d", op))
+		}
+
+		if !fin {
+			fragmented = true
+			continue
+		}
+
+		if opcode == wsText && !utf8.Valid(message) {
+			return 0, nil, wsProtocolError(wsCloseInvalidData, "text message not UTF-8")
+		}
+
+		return opcode, message, nil
+	}
+}
@@ -0,0 +1,309 @@
+package connectionmanager
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The client end of a WebSocket, for tests
+type wsTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+
+	// subprotocol the server picked
+	protocol string
+}
+
+// Open a WebSocket to a test server
+func dialWebSocket(t *testing.T, server *httptest.Server, query string) *wsTestClient {
+	return dialWebSocketProtocols(t, server, query, "")
+}
+
+// Open a WebSocket to a test server, offering subprotocols (a
+// comma-separated list) if they're given
+func dialWebSocketProtocols(t *testing.T, server *httptest.Server, query string, protocols string) *wsTestClient {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	offer := ""
+	if protocols != "" {
+		offer = "Sec-WebSocket-Protocol: " + protocols + "\r\n"
+	}
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	conn.Write([]byte("GET /ws?" + query + " HTTP/1.1\r\n" +
+		"Host: " + server.Listener.Addr().String() + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		offer +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake: status %d", resp.StatusCode)
+	}
+
+	// the example from RFC 6455
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake: bad accept %q", accept)
+	}
+
+	return &wsTestClient{t: t, conn: conn, r: r, protocol: resp.Header.Get("Sec-WebSocket-Protocol")}
+}
+
+// Send a masked frame
+func (c *wsTestClient) send(opcode byte, data []byte) {
+	mask := []byte{1, 2, 3, 4}
+
+	buf := []byte{0x80 | opcode}
+	if len(data) < 126 {
+		buf = append(buf, 0x80|byte(len(data)))
+	} else {
+		buf = append(buf, 0x80|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(data)))
+	}
+	buf = append(buf, mask...)
+
+	for i, b := range data {
+		buf = append(buf, b^mask[i%4])
+	}
+
+	if _, err := c.conn.Write(buf); err != nil {
+		c.t.Fatalf("Write: %v", err)
+	}
+}
+
+// Read a frame
+func (c *wsTestClient) receive() (byte, []byte) {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	var h [2]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		c.t.Fatalf("Read: %v", err)
+	}
+
+	n := int(h[1] & 0x7f)
+	if n == 126 {
+		var ext [2]byte
+		io.ReadFull(c.r, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		c.t.Fatalf("Read: %v", err)
+	}
+
+	return h[0] & 0x0f, data
+}
+
+// Read a pushed message or command response
+func (c *wsTestClient) receiveJSON(v interface{}) {
+	opcode, data := c.receive()
+	if opcode != wsText {
+		c.t.Fatalf("expected text frame, got opcode %d", opcode)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		c.t.Fatalf("bad JSON %q: %v", data, err)
+	}
+}
+
+func TestWebSocketHandler(t *testing.T) {
+	cm := startTestManager(t, "alice", "bob")
+	defer cm.SetActive(false)
+
+	mux := http.NewServeMux()
+	mux.Handle("/ws", NewWebSocketHandler(cm))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// unknown IDs are turned away before the upgrade
+	resp, err := http.Get(server.URL + "/ws?id=nobody")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown id, got %d", resp.StatusCode)
+	}
+
+	c := dialWebSocket(t, server, "id=alice")
+	defer c.conn.Close()
+
+	// messages are pushed as they arrive
+	unicastTest(t, cm, "bob", "alice", "hi")
+
+	var m lineMessage[*MessagePayload]
+	c.receiveJSON(&m)
+	if m.Type != "unicast" || m.Id != "bob" || (*m.Payload)["text"] != "hi" {
+		t.Errorf("unexpected message %+v", m)
+	}
+
+	// commands come back with a response, and act as the socket's
+	// connection
+	c.send(wsText, []byte(`{"seq":1,"op":"broadcast","id":"bob","payload":{"text":"yo"}}`))
+
+	var r lineResponse[*MessagePayload]
+	var pushed lineMessage[*MessagePayload]
+
+	// the push and the response can come in either order
+	for i := 0; i < 2; i++ {
+		var raw map[string]interface{}
+		c.receiveJSON(&raw)
+		data, _ := json.Marshal(raw)
+
+		if _, ok := raw["ok"]; ok {
+			json.Unmarshal(data, &r)
+		} else {
+			json.Unmarshal(data, &pushed)
+		}
+	}
+
+	if r.Seq != 1 || !r.Ok {
+		t.Errorf("unexpected response %+v", r)
+	}
+	if pushed.Type != "broadcast" || pushed.Id != "alice" || (*pushed.Payload)["text"] != "yo" {
+		t.Errorf("unexpected message %+v", pushed)
+	}
+
+	c.send(wsText, []byte(`{"seq":2,"op":"poll"}`))
+	c.receiveJSON(&r)
+	if r.Seq != 2 || r.Ok {
+		t.Errorf("expected poll to be refused, got %+v", r)
+	}
+
+	// pings are answered
+	c.send(wsPing, []byte("ping"))
+	if opcode, data := c.receive(); opcode != wsPong || string(data) != "ping" {
+		t.Errorf("expected pong, got %d %q", opcode, data)
+	}
+
+	// and closes are echoed
+	c.send(wsClose, []byte{0x03, 0xe8})
+	if opcode, data := c.receive(); opcode != wsClose || len(data) != 2 {
+		t.Errorf("expected close, got %d %q", opcode, data)
+	}
+}
+
+func TestWebSocketUnmasked(t *testing.T) {
+	cm := startTestManager(t, "alice")
+	defer cm.SetActive(false)
+
+	server := httptest.NewServer(NewWebSocketHandler(cm))
+	defer server.Close()
+
+	c := dialWebSocket(t, server, "id=alice")
+	defer c.conn.Close()
+
+	// clients must mask their frames
+	c.conn.Write([]byte{0x81, 0x02, 'h', 'i'})
+
+	opcode, data := c.receive()
+	if opcode != wsClose || binary.BigEndian.Uint16(data) != wsCloseProtocolError || !strings.Contains(string(data), "masked") {
+		t.Errorf("expected protocol error close, got %d %q", opcode, data)
+	}
+}
+
+func TestWebSocketAbandon(t *testing.T) {
+	cm := startTestManager(t, "alice")
+	defer cm.SetActive(false)
+
+	server := httptest.NewServer(NewWebSocketHandler(cm))
+	defer server.Close()
+
+	// a message that arrives after the socket closes waits for the
+	// next one
+	c := dialWebSocket(t, server, "id=alice")
+	c.conn.Close()
+	time.Sleep(20 * time.Millisecond)
+	broadcastTest(t, cm, &Message{Id: "bob"}, "hi")
+
+	c = dialWebSocket(t, server, "id=alice")
+
+	var m lineMessage[*MessagePayload]
+	c.receiveJSON(&m)
+	if (*m.Payload)["text"] != "hi" || m.Seq == 0 {
+		t.Fatalf("expected hi with a seq, got %+v", m)
+	}
+	seq := m.Seq
+
+	broadcastTest(t, cm, &Message{Id: "bob"}, "again")
+	c.receiveJSON(&m)
+	c.conn.Close()
+
+	// reconnecting with seq pushes what came after it again
+	c = dialWebSocket(t, server, fmt.Sprintf("id=alice&seq=%d", seq))
+
+	c.receiveJSON(&m)
+	if (*m.Payload)["text"] != "again" {
+		t.Errorf("expected again, got %+v", m)
+	}
+	c.conn.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	// a request that fails the handshake doesn't keep the poll either
+	hr, err := http.Get(server.URL + "?id=alice")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	hr.Body.Close()
+	if hr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, hr.StatusCode)
+	}
+
+	broadcastTest(t, cm, &Message{Id: "bob"}, "still here")
+
+	c = dialWebSocket(t, server, "id=alice")
+	defer c.conn.Close()
+
+	c.receiveJSON(&m)
+	if (*m.Payload)["text"] != "still here" {
+		t.Errorf("expected still here, got %+v", m)
+	}
+}
+
+func TestWebSocketCodec(t *testing.T) {
+	cm := startTestManager(t, "alice", "bob")
+	defer cm.SetActive(false)
+
+	mux := http.NewServeMux()
+	mux.Handle("/ws", NewWebSocketHandler(cm))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c := dialWebSocketProtocols(t, server, "id=alice", "msgpack, binary")
+	defer c.conn.Close()
+
+	if c.protocol != "binary" {
+		t.Fatalf("expected the binary subprotocol, got %q", c.protocol)
+	}
+
+	unicastTest(t, cm, "bob", "alice", "hi")
+
+	var m lineMessage[*MessagePayload]
+	c.receiveJSON(&m)
+
+	var payload *MessagePayload
+	if err := BinaryCodec.Unmarshal(m.Data, &payload); err != nil || (*payload)["text"] != "hi" {
+		t.Errorf("expected hi encoded in data, got %+v %v", m, err)
+	}
+}
@@ -0,0 +1,231 @@
+// WebSocket push handler
+
+package connectionmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How long a WebSocketHandler's polls wait for messages before it
+// pings the client instead
+const wsPingInterval = 30 * time.Second
+
+// Pushes a Manager's messages to WebSocket clients (implements
+// http.Handler)
+//
+// Each socket is bound to the connection named by the "id" parameter
+// of the request, which must already exist, and to the "session"
+// parameter if it's given. Messages are pushed as soon as they're
+// delivered, one per text message, as JSON objects in the same form as
+// a LineServer poll's messages:
+//
+//	{"type":"broadcast","seq":1,"id":"alice","payload":{"text":"hi"}}
+//
+// A client that reconnects with the "seq" parameter set to the "seq"
+// of the last message it received is first pushed again whatever its
+// session was sent after it, as far as the session remembers. A batch
+// that arrives as the socket closes is kept for the session's next
+// poll.
+//
+// Clients may offer codec names as subprotocols, and the first one the
+// handler knows is used for payloads, which then travel in "data"
+// rather than "payload" (see LineServer). With none offered, payloads
+// are JSON.
+//
+// Clients send commands as text messages in the LineServer request
+// format, and each is answered with a response carrying its "seq" and
+// "ok" (pushed messages have a "type" instead).
+// Commands act for the bound connection, whatever "id" they give, and
+// can't be polls, since messages are pushed. Credentials for the
+// manager's Authorizer come from the "token" parameter of the request,
+// unless a command gives its own.
+type WebSocketHandler[T any] struct {
+	cm *Manager[T]
+
+	// Decides whether to accept a handshake, usually by its Origin
+	// header. If nil, only pages from the same host (and clients that
+	// aren't browsers) are accepted.
+	CheckOrigin func(rq *http.Request) bool
+}
+
+// Create a WebSocketHandler for a Manager
+func NewWebSocketHandler[T any](cm *Manager[T]) *WebSocketHandler[T] {
+	return &WebSocketHandler[T]{cm: cm}
+}
+
+// Start a poll for the socket's connection
+func (h *WebSocketHandler[T]) poll(id string, session string, credentials interface{}, after uint64) *TypedMessage[T] {
+	return h.cm.SendMessage(&TypedMessage[T]{
+		Type:        PollRequest,
+		Id:          id,
+		Session:     session,
+		Credentials: credentials,
+		Seq:         after,
+		Timeout:     wsPingInterval,
+	})
+}
+
+// Serve a WebSocket handshake, then push messages and take commands
+// until the socket closes
+func (h *WebSocketHandler[T]) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
+	id := rq.FormValue("id")
+	session := rq.FormValue("session")
+	credentials := requestCredentials(rq)
+
+	// an unparseable seq just means starting afresh
+	after, _ := strconv.ParseUint(rq.FormValue("seq"), 10, 64)
+
+	checkOrigin := h.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = wsSameOrigin
+	}
+
+	if !checkOrigin(rq) {
+		http.Error(rw, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	offered := wsProtocols(rq.Header)
+
+	codec, err := NegotiateCodec(offered)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	protocol := ""
+	if len(offered) > 0 {
+		protocol = codec.Name()
+	}
+
+	// poll before upgrading, so an unknown ID gets a plain HTTP error
+	resp := h.poll(id, session, credentials, after)
+	if resp.Err != nil {
+		http.Error(rw, resp.Err.Error(), pollErrorStatus(resp.Err))
+		return
+	}
+
+	ws, err := wsUpgrade(rw, rq, protocol)
+	if err != nil {
+		// nothing will read the poll, so leave the next batch queued
+		h.cm.SendMessage(&TypedMessage[T]{
+			Type:        AbandonRequest,
+			Id:          id,
+			Session:     session,
+			PollChan:    resp.PollChan,
+			Credentials: credentials,
+		})
+
+		return
+	}
+	defer ws.conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go h.push(ws, id, session, credentials, codec, resp.PollChan, done)
+
+	if err := h.receive(ws, id, credentials, codec); err != nil {
+		if e, ok := err.(*wsError); ok {
+			ws.close(e.code, e.reason)
+		}
+	}
+}
+
+// Push batches to the client as they're delivered, polling again after
+// each (runs as a goroutine)
+func (h *WebSocketHandler[T]) push(ws *wsConn, id string, session string, credentials interface{}, codec Codec, pollChan chan *[]*TypedEnvelope[T], done chan struct{}) {
+	for {
+		select {
+		case batch, ok := <-pollChan:
+			if !ok {
+				// disconnected, or another socket took the session
+				ws.close(wsCloseGoingAway, "poll canceled")
+				ws.conn.Close()
+				return
+			}
+
+			if len(*batch) == 0 {
+				// nothing for a while; make sure the client's there
+				if ws.writeFrame(wsPing, nil) != nil {
+					return
+				}
+			}
+
+			for _, e := range *batch {
+				data, err := json.Marshal(newLineMessage(e, codec))
+				if err == nil {
+					err = ws.writeText(data)
+				}
+
+				if err != nil {
+					ws.conn.Close()
+					return
+				}
+			}
+
+		case <-done:
+			// the socket's gone; don't let the next batch go with it
+			h.cm.SendMessage(&TypedMessage[T]{
+				Type:        AbandonRequest,
+				Id:          id,
+				Session:     session,
+				PollChan:    pollChan,
+				Credentials: credentials,
+			})
+
+			return
+		}
+
+		resp := h.poll(id, session, credentials, 0)
+		if resp.Err != nil {
+			ws.close(wsCloseGoingAway, resp.Err.Error())
+			ws.conn.Close()
+			return
+		}
+
+		pollChan = resp.PollChan
+	}
+}
+
+// Carry out commands from the client until the socket closes
+func (h *WebSocketHandler[T]) receive(ws *wsConn, id string, credentials interface{}, codec Codec) error {
+	for {
+		opcode, data, err := ws.readMessage()
+		if err != nil {
+			return err
+		}
+
+		var rq lineRequest[T]
+		var r *lineResponse[T]
+
+		if opcode != wsText {
+			r = lineResult[T](&rq, errors.New("commands must be text messages"))
+		} else if err := json.Unmarshal(data, &rq); err != nil {
+			r = lineResult[T](&rq, errors.New("bad request: "+err.Error()))
+		} else if rq.Op == "poll" {
+			r = lineResult[T](&rq, errors.New("messages are pushed; no need to poll"))
+		} else {
+			rq.Id = id
+
+			if token, ok := credentials.(string); ok && rq.Token == "" {
+				rq.Token = token
+			}
+
+			r = lineHandle(h.cm, &rq, codec, nil)
+		}
+
+		data, err = json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		if err := ws.writeText(data); err != nil {
+			return err
+		}
+	}
+}